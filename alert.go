@@ -0,0 +1,195 @@
+package seconn
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The reason a connection is being torn down, sent to the peer in an
+// alert so that it doesn't just see the connection drop.
+type AlertCode uint16
+
+const (
+	AlertProtocolError      AlertCode = 1
+	AlertDecryptError       AlertCode = 2
+	AlertBadRekey           AlertCode = 3
+	AlertRecordTooLarge     AlertCode = 4
+	AlertUnsupportedVersion AlertCode = 5
+	AlertNoCipherSuite      AlertCode = 6
+	AlertHandshakeFailed    AlertCode = 7
+	AlertBadIdentity        AlertCode = 8
+	AlertAuthFailed         AlertCode = 9
+	AlertInternalError      AlertCode = 10
+)
+
+var alertNames = map[AlertCode]string{
+	AlertProtocolError:      "protocol error",
+	AlertDecryptError:       "decrypt error",
+	AlertBadRekey:           "bad rekey",
+	AlertRecordTooLarge:     "record too large",
+	AlertUnsupportedVersion: "unsupported version",
+	AlertNoCipherSuite:      "no cipher suite",
+	AlertHandshakeFailed:    "handshake failed",
+	AlertBadIdentity:        "bad identity",
+	AlertAuthFailed:         "authentication failed",
+	AlertInternalError:      "internal error",
+}
+
+func (a AlertCode) String() string {
+	if name, ok := alertNames[a]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("alert(%d)", uint16(a))
+}
+
+// The longest reason sent in an alert. Longer ones are cut short, so
+// that with the 2 byte code the alert fits in a record of MinRecordSize
+// and every peer can read it.
+const maxAlertReason = MinRecordSize - 2
+
+// Returned from Read, Write and Negotiate when the peer sent an alert
+type AlertError struct {
+	Code   AlertCode
+	Reason string
+}
+
+func (a *AlertError) Error() string {
+	if a.Reason == "" {
+		return "seconn: peer sent alert: " + a.Code.String()
+	}
+
+	return "seconn: peer sent alert: " + a.Code.String() + ": " + a.Reason
+}
+
+func marshalAlert(code AlertCode, reason string) []byte {
+	if len(reason) > maxAlertReason {
+		reason = reason[:maxAlertReason]
+	}
+
+	buf := make([]byte, 2+len(reason))
+
+	binary.BigEndian.PutUint16(buf, uint16(code))
+	copy(buf[2:], reason)
+
+	return buf
+}
+
+func unmarshalAlert(data []byte) (*AlertError, error) {
+	if len(data) < 2 || len(data) > 2+maxAlertReason {
+		return nil, ErrBadLength
+	}
+
+	return &AlertError{
+		Code:   AlertCode(binary.BigEndian.Uint16(data)),
+		Reason: string(data[2:]),
+	}, nil
+}
+
+// The alert to send the peer when we fail with err. Errors that mean
+// the connection itself is gone, or that come from the peer, have none.
+func alertFor(err error) (AlertCode, bool) {
+	switch err {
+	case ErrProtocolError, ErrBadLength, ErrMalformedKey:
+		return AlertProtocolError, true
+	case ErrBadHeader, ErrDecryptFailed:
+		return AlertDecryptError, true
+	case ErrBadRekey:
+		return AlertBadRekey, true
+	case ErrRecordTooLarge:
+		return AlertRecordTooLarge, true
+	case ErrUnsupportedVersion:
+		return AlertUnsupportedVersion, true
+	case ErrNoCipherSuite, ErrUnknownCipherSuite, ErrNoiseCipherSuite:
+		return AlertNoCipherSuite, true
+	case ErrHandshakeFailed, ErrNoisePattern:
+		return AlertHandshakeFailed, true
+	case ErrBadIdentity, ErrNoPeerIdentity, ErrUnsupportedIdentity:
+		return AlertBadIdentity, true
+	}
+
+	return 0, false
+}
+
+// Send an alert record. Nothing more can be written afterwards.
+func (c *Conn) sendAlert(code AlertCode, reason string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.write == nil {
+		return nil
+	}
+
+	err := c.writeRecord(pAlert, marshalAlert(code, reason))
+
+	c.closeSent = true
+
+	return err
+}
+
+// Tell the peer why the handshake failed with err, if there's anything
+// useful to say. While the peer is still in the handshake the alert is
+// sent as a handshake message, but once it has sent its last one it's
+// expecting records, so we can only send one if we have the keys.
+func (c *Conn) handshakeAlert(err error) {
+	if c.alerted {
+		return
+	}
+
+	if _, ok := err.(*AlertError); ok {
+		return
+	}
+
+	code, ok := alertFor(err)
+
+	if c.authFailed {
+		code, ok = AlertAuthFailed, true
+	}
+
+	if !ok {
+		return
+	}
+
+	c.alerted = true
+
+	if c.peerDone {
+		c.sendAlert(code, "")
+		return
+	}
+
+	c.writeHandshake(msgAlert, marshalAlert(code, ""))
+}
+
+// Send the peer an alert with code and reason, then close the
+// connection. Use this to report failures such as an auth exchange
+// being rejected, so the peer can tell why it was disconnected.
+func (c *Conn) Alert(code AlertCode, reason string) error {
+	err := c.sendAlert(code, reason)
+
+	// The alert counts as our close notify, so this just tears down
+	// the connection along with its timers.
+	cerr := c.Close()
+	if err != nil {
+		return err
+	}
+
+	return cerr
+}
+
+func (c *Conn) readAlert(cnt uint32) error {
+	buf, err := c.readAndCheck(cnt)
+	if err != nil {
+		return err
+	}
+
+	alert, err := unmarshalAlert(buf)
+	if err != nil {
+		return err
+	}
+
+	c.writeLock.Lock()
+	c.peerAlert = alert
+	c.writeLock.Unlock()
+
+	return alert
+}
@@ -0,0 +1,150 @@
+package seconn
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlertMarshal(t *testing.T) {
+	alert, err := unmarshalAlert(marshalAlert(AlertBadRekey, "why"))
+	require.NoError(t, err)
+	assert.Equal(t, &AlertError{Code: AlertBadRekey, Reason: "why"}, alert)
+
+	assert.Equal(t, "seconn: peer sent alert: bad rekey: why", alert.Error())
+
+	alert, err = unmarshalAlert(marshalAlert(AlertAuthFailed, strings.Repeat("x", 1000)))
+	require.NoError(t, err)
+	assert.Len(t, alert.Reason, maxAlertReason)
+
+	_, err = unmarshalAlert([]byte{1})
+	assert.Equal(t, ErrBadLength, err)
+
+	assert.Equal(t, "alert(999)", AlertCode(999).String())
+}
+
+func TestAlertOnDecryptError(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	raw := wc.Conn
+
+	cc := &countingConn{Conn: raw, hold: true}
+	wc.Conn = cc
+
+	_, err := wc.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	wc.Conn = raw
+
+	rec := cc.held.Bytes()
+	rec[len(rec)-1] ^= 0xff
+
+	_, err = raw.Write(rec)
+	require.NoError(t, err)
+
+	_, err = wo.Read(make([]byte, 5))
+	assert.Equal(t, ErrDecryptFailed, err)
+
+	// Reading can't continue after that
+	_, err = wo.Read(make([]byte, 5))
+	assert.Equal(t, ErrDecryptFailed, err)
+
+	expected := &AlertError{Code: AlertDecryptError}
+
+	_, err = wc.Read(make([]byte, 5))
+	assert.Equal(t, expected, err)
+
+	_, err = wc.Write([]byte("again"))
+	assert.Equal(t, expected, err)
+}
+
+func TestAlertExplicit(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wc.Close()
+
+	require.NoError(t, wo.Alert(AlertAuthFailed, "unknown token"))
+
+	_, err := wc.Read(make([]byte, 5))
+	assert.Equal(t, &AlertError{Code: AlertAuthFailed, Reason: "unknown token"}, err)
+}
+
+func TestAlertLongReasonToSmallestRecords(t *testing.T) {
+	cfg := &Config{MaxRecordSize: MinRecordSize}
+
+	wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wc.Close()
+
+	reason := strings.Repeat("x", 300)
+
+	require.NoError(t, wo.Alert(AlertAuthFailed, reason))
+
+	_, err := wc.Read(make([]byte, 5))
+	assert.Equal(t, &AlertError{Code: AlertAuthFailed, Reason: reason[:maxAlertReason]}, err)
+}
+
+func TestAlertDuringHandshake(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	errUnknown := errors.New("unknown key")
+
+	reject := func(key crypto.PublicKey) error {
+		return errUnknown
+	}
+
+	expected := &AlertError{Code: AlertAuthFailed}
+
+	// The client rejects the server while the server is still waiting
+	// on the handshake.
+	_, _, serr, cerr := negotiatePair(t, &Config{Identity: priv}, &Config{VerifyPeerIdentity: reject})
+	assert.Equal(t, errUnknown, cerr)
+	assert.Equal(t, expected, serr)
+
+	// The server rejects the client after the client is done, so it
+	// only finds out when it reads.
+	wo, wc, serr, cerr := negotiatePair(t, &Config{VerifyPeerIdentity: reject}, &Config{Identity: priv})
+	assert.Equal(t, errUnknown, serr)
+	require.NoError(t, cerr)
+
+	wo.Conn.Close()
+
+	_, err = wc.Read(make([]byte, 5))
+	assert.Equal(t, expected, err)
+
+	wc.Close()
+
+	// The same goes for VerifyConnection
+	scfg := &Config{
+		VerifyConnection: func(c *Conn) error {
+			return errUnknown
+		},
+	}
+
+	wo, wc, serr, cerr = negotiatePair(t, scfg, nil)
+	assert.Equal(t, errUnknown, serr)
+	require.NoError(t, cerr)
+
+	wo.Conn.Close()
+
+	_, err = wc.Read(make([]byte, 5))
+	assert.Equal(t, expected, err)
+
+	wc.Close()
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/gob"
+	"math/big"
+)
+
+// Older versions of this package sent auth messages with encoding/gob.
+// Gob can only be read by Go, and a decoder fed untrusted input does far
+// more work than the wire format needs, so it's only used on connections
+// wrapped with GobCompat. Signed tokens are ECDSA P-256 only, signed
+// without hashing them first.
+
+type gobConn struct {
+	MessageConnection
+}
+
+// Exchange auth messages with conn in the gob encoding used by older
+// versions of this package, for peers that haven't been upgraded. Pass
+// the result to the auth functions in place of conn. Both sides have to
+// agree to use it.
+func GobCompat(conn MessageConnection) MessageConnection {
+	return &gobConn{conn}
+}
+
+func isGob(conn MessageConnection) bool {
+	_, ok := conn.(*gobConn)
+	return ok
+}
+
+type gobSignedToken struct {
+	Token      []byte
+	KeyID      string
+	SignatureR *big.Int
+	SignatureS *big.Int
+}
+
+type gobSignedShared struct {
+	Token     []byte
+	Signature []byte
+}
+
+func decodeGob(msg []byte, v interface{}) error {
+	if len(msg) > maxMessageSize {
+		return ErrMalformedMessage
+	}
+
+	return gob.NewDecoder(bytes.NewReader(msg)).Decode(v)
+}
+
+func encodeGob(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func verifyGobSignedToken(conn MessageConnection, msg []byte, keys KeyProvider) error {
+	var signed gobSignedToken
+
+	err := decodeGob(msg, &signed)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(conn.PeerAuthToken(), signed.Token) {
+		return ErrWrongToken
+	}
+
+	key, err := keys.GetKey(signed.KeyID)
+	if err != nil {
+		return err
+	}
+
+	alg, err := algorithmOf(key)
+	if err != nil {
+		return err
+	}
+
+	if alg != ECDSAP256 {
+		return ErrAlgorithmMismatch
+	}
+
+	if signed.SignatureR == nil || signed.SignatureS == nil {
+		return ErrInvalidSignature
+	}
+
+	if !ecdsa.Verify(key.(*ecdsa.PublicKey), signed.Token, signed.SignatureR, signed.SignatureS) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func sendGobSignedToken(conn MessageConnection, id string, key crypto.Signer) error {
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok || priv.Curve != elliptic.P256() {
+		return ErrUnsupportedKey
+	}
+
+	token := conn.AuthToken()
+
+	r, s, err := ecdsa.Sign(randReader, priv, token)
+	if err != nil {
+		return err
+	}
+
+	msg, err := encodeGob(&gobSignedToken{
+		Token:      token,
+		KeyID:      id,
+		SignatureR: r,
+		SignatureS: s,
+	})
+	if err != nil {
+		return err
+	}
+
+	return conn.SendMessage(msg)
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGobCompatSignedToken(t *testing.T) {
+	var server, client MockMessageConnection
+	var key MockKeyProvider
+
+	k1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	token := []byte("aabbcc")
+
+	// Signed the way older versions did it
+	r, s, err := ecdsa.Sign(rand.Reader, k1, token)
+	require.NoError(t, err)
+
+	msg1, err := encodeGob(&gobSignedToken{
+		Token:      token,
+		KeyID:      "k1",
+		SignatureR: r,
+		SignatureS: s,
+	})
+	require.NoError(t, err)
+
+	client.On("GetMessage").Return(msg1, nil)
+	client.On("PeerAuthToken").Return(token)
+
+	key.On("GetKey", "k1").Return(&k1.PublicKey, nil)
+
+	// Without the option, the gob message is rejected
+	err = VerifySignedToken(&client, &key)
+	require.Error(t, err)
+
+	err = VerifySignedToken(GobCompat(&client), &key)
+	require.NoError(t, err)
+
+	var sent []byte
+
+	server.On("AuthToken").Return(token)
+	server.On("SendMessage", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		sent = args.Get(0).([]byte)
+	})
+
+	err = SendSignedToken(GobCompat(&server), "k1", k1)
+	require.NoError(t, err)
+
+	var signed gobSignedToken
+	require.NoError(t, decodeGob(sent, &signed))
+	require.True(t, ecdsa.Verify(&k1.PublicKey, token, signed.SignatureR, signed.SignatureS))
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	err = SendSignedToken(GobCompat(&server), "k1", priv)
+	require.Equal(t, ErrUnsupportedKey, err)
+}
+
+func TestGobCompatSharedKey(t *testing.T) {
+	var client MockMessageConnection
+
+	token := []byte("aabbcc")
+	dk := make([]byte, 32)
+
+	hm := hmac.New(sha256.New, dk)
+	hm.Write(token)
+
+	msg1, err := encodeGob(&gobSignedShared{
+		Token:     token,
+		Signature: hm.Sum(nil),
+	})
+	require.NoError(t, err)
+
+	client.On("GetMessage").Return(msg1, nil)
+	client.On("PeerAuthToken").Return(token)
+
+	err = VerifySharedKey(GobCompat(&client), dk)
+	require.NoError(t, err)
+}
+
+func TestGobCompatSizeLimit(t *testing.T) {
+	msg1, err := encodeGob(&gobSignedShared{Token: make([]byte, maxMessageSize)})
+	require.NoError(t, err)
+
+	var signed gobSignedShared
+	require.Equal(t, ErrMalformedMessage, decodeGob(msg1, &signed))
+}
@@ -1,22 +1,38 @@
 package auth
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"io/ioutil"
 )
 
+// A single public key in a file, either a raw 32 byte Ed25519 key or an
+// uncompressed P-256 point.
 type KeyFile struct {
 	Path string
 }
 
-func (k *KeyFile) GetKey(id string) (*ecdsa.PublicKey, error) {
+func (k *KeyFile) GetKey(id string) (crypto.PublicKey, error) {
 	data, err := ioutil.ReadFile(k.Path)
 	if err != nil {
 		return nil, err
 	}
 
+	return parsePublicKey(data)
+}
+
+// Parse a raw 32 byte Ed25519 key or an uncompressed P-256 point
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	if len(data) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(data), nil
+	}
+
 	x, y := elliptic.Unmarshal(elliptic.P256(), data)
+	if x == nil {
+		return nil, ErrUnsupportedKey
+	}
 
 	pkey := &ecdsa.PublicKey{
 		Curve: elliptic.P256(),
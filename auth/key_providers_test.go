@@ -2,9 +2,11 @@ package auth
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -34,3 +36,23 @@ func TestKeyFile(t *testing.T) {
 
 	assert.Equal(t, &key.PublicKey, fkey)
 }
+
+func TestKeyFileEd25519(t *testing.T) {
+	file, err := ioutil.TempFile("", "key")
+	require.NoError(t, err)
+
+	defer os.Remove(file.Name())
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	_, err = file.Write(pub)
+	require.NoError(t, err)
+
+	file.Close()
+
+	fkey, err := KeyFromFile(file.Name()).GetKey("x")
+	require.NoError(t, err)
+
+	assert.Equal(t, pub, fkey)
+}
@@ -2,16 +2,16 @@ package auth
 
 import "github.com/stretchr/testify/mock"
 
-import "crypto/ecdsa"
+import "crypto"
 
 type MockKeyProvider struct {
 	mock.Mock
 }
 
-func (m *MockKeyProvider) GetKey(id string) (*ecdsa.PublicKey, error) {
+func (m *MockKeyProvider) GetKey(id string) (crypto.PublicKey, error) {
 	ret := m.Called(id)
 
-	r0 := ret.Get(0).(*ecdsa.PublicKey)
+	r0 := ret.Get(0)
 	r1 := ret.Error(1)
 
 	return r0, r1
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto"
+	"errors"
+)
+
+// Mutual has both sides prove who they are with signed tokens in one
+// call. The messages always go in this order, so neither side can end
+// up waiting on the other:
+//
+//   client -> server   client's signed token
+//   server -> client   server's signed token
+//   server -> client   verdict on the client's token
+//   client -> server   verdict on the server's token
+//
+// If the client's token doesn't check out, the server sends only its
+// verdict, so a client that hasn't proved who it is never gets a
+// signature from the server. Each side only succeeds if both verdicts
+// are good, so both sides see the same ErrAuthFailed whichever proof
+// was bad.
+
+var ErrAuthFailed = errors.New("mutual authentication failed")
+
+// Who we prove to be in Mutual
+type Identity struct {
+	// Which end of the session we are
+	Role Role
+
+	// The id the peer looks our public key up by
+	KeyID string
+
+	// Signs our auth token, as in SendSignedToken
+	Key crypto.Signer
+}
+
+// A peer whose signed token has been checked
+type PeerIdentity struct {
+	KeyID string
+	Key   crypto.PublicKey
+}
+
+// Prove to the peer that we're local and check who the peer is, with
+// verifier providing its public key. The peer must call Mutual too,
+// with the other role. Returns the peer's identity once both sides have
+// accepted the other's proof.
+func Mutual(conn MessageConnection, local Identity, verifier KeyProvider) (*PeerIdentity, error) {
+	if local.Role != Client && local.Role != Server {
+		return nil, ErrUnknownRole
+	}
+
+	// Nothing is sent until we know we can sign our proof
+
+	proof, err := signToken(conn, local.KeyID, local.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		msg      []byte
+		peer     *PeerIdentity
+		checkErr error
+		accepted bool
+	)
+
+	if local.Role == Client {
+		err = conn.SendMessage(proof)
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err = conn.GetMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		// The server turned down our token and won't send its own
+		if messageType(msg) == msgVerdict {
+			accepted, err = parseVerdict(msg)
+			if err != nil {
+				return nil, err
+			}
+
+			if accepted {
+				return nil, ErrMalformedMessage
+			}
+
+			return nil, ErrAuthFailed
+		}
+
+		peer, checkErr = checkSignedToken(conn, msg, verifier)
+
+		accepted, err = getVerdict(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		err = sendVerdict(conn, checkErr == nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		msg, err = conn.GetMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		peer, checkErr = checkSignedToken(conn, msg, verifier)
+		if checkErr != nil {
+			err = sendVerdict(conn, false)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, ErrAuthFailed
+		}
+
+		err = conn.SendMessage(proof)
+		if err != nil {
+			return nil, err
+		}
+
+		err = sendVerdict(conn, true)
+		if err != nil {
+			return nil, err
+		}
+
+		accepted, err = getVerdict(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if checkErr != nil || !accepted {
+		return nil, ErrAuthFailed
+	}
+
+	return peer, nil
+}
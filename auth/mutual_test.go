@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type keyMap map[string]crypto.PublicKey
+
+func (k keyMap) GetKey(id string) (crypto.PublicKey, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, errors.New("unknown key " + id)
+	}
+
+	return key, nil
+}
+
+type mutualSetup struct {
+	clientKey, serverKey crypto.Signer
+	clientKeys           keyMap
+	serverKeys           keyMap
+}
+
+func newMutualSetup(t *testing.T) *mutualSetup {
+	ck, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	return &mutualSetup{
+		clientKey:  ck,
+		serverKey:  sk,
+		clientKeys: keyMap{"server": sk.Public()},
+		serverKeys: keyMap{"client": ck.Public()},
+	}
+}
+
+func (m *mutualSetup) run(client, server *messagePipe) (cpeer, speer *PeerIdentity, cerr, serr error) {
+	cerr, serr = runPair(client, server, func(conn MessageConnection, role Role) error {
+		var err error
+
+		if role == Client {
+			cpeer, err = Mutual(conn, Identity{Role: Client, KeyID: "client", Key: m.clientKey}, m.clientKeys)
+		} else {
+			speer, err = Mutual(conn, Identity{Role: Server, KeyID: "server", Key: m.serverKey}, m.serverKeys)
+		}
+
+		return err
+	})
+
+	return cpeer, speer, cerr, serr
+}
+
+func TestMutual(t *testing.T) {
+	m := newMutualSetup(t)
+
+	client, server := newMessagePipe([]byte("client token"), []byte("server token"))
+
+	cpeer, speer, cerr, serr := m.run(client, server)
+	require.NoError(t, cerr)
+	require.NoError(t, serr)
+
+	assert.Equal(t, &PeerIdentity{KeyID: "server", Key: m.serverKey.Public()}, cpeer)
+	assert.Equal(t, &PeerIdentity{KeyID: "client", Key: m.clientKey.Public()}, speer)
+
+	assert.Equal(t, []byte{msgSignedToken, msgVerdict}, messageTypes(client.sent))
+	assert.Equal(t, []byte{msgSignedToken, msgVerdict}, messageTypes(server.sent))
+}
+
+func TestMutualFailsTheSameWay(t *testing.T) {
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		breakIt func(m *mutualSetup)
+
+		// Whether the server signs anything
+		serverSigns bool
+	}{
+		"bad client proof": {func(m *mutualSetup) { m.clientKey = other }, false},
+		"bad server proof": {func(m *mutualSetup) { m.clientKeys["server"] = other.Public() }, true},
+		"unknown client":   {func(m *mutualSetup) { delete(m.serverKeys, "client") }, false},
+		"both bad": {func(m *mutualSetup) {
+			m.clientKey = other
+			delete(m.clientKeys, "server")
+		}, false},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := newMutualSetup(t)
+			c.breakIt(m)
+
+			client, server := newMessagePipe([]byte("client token"), []byte("server token"))
+
+			cpeer, speer, cerr, serr := m.run(client, server)
+			assert.Equal(t, ErrAuthFailed, cerr)
+			assert.Equal(t, ErrAuthFailed, serr)
+			assert.Nil(t, cpeer)
+			assert.Nil(t, speer)
+
+			if c.serverSigns {
+				assert.Equal(t, []byte{msgSignedToken, msgVerdict}, messageTypes(client.sent))
+				assert.Equal(t, []byte{msgSignedToken, msgVerdict}, messageTypes(server.sent))
+			} else {
+				// A client that failed to prove itself only gets the verdict
+				assert.Equal(t, []byte{msgSignedToken}, messageTypes(client.sent))
+				assert.Equal(t, []byte{msgVerdict}, messageTypes(server.sent))
+			}
+		})
+	}
+}
+
+func TestMutualDifferentSessions(t *testing.T) {
+	m := newMutualSetup(t)
+
+	client, server := newMessagePipe([]byte("client token"), []byte("server token"))
+	server.peerToken = []byte("other client token")
+
+	_, _, cerr, serr := m.run(client, server)
+	assert.Equal(t, ErrAuthFailed, cerr)
+	assert.Equal(t, ErrAuthFailed, serr)
+}
+
+func TestMutualUnknownRole(t *testing.T) {
+	m := newMutualSetup(t)
+
+	client, _ := newMessagePipe(nil, nil)
+
+	_, err := Mutual(client, Identity{KeyID: "client", Key: m.clientKey}, m.clientKeys)
+	assert.Equal(t, ErrUnknownRole, err)
+	assert.Empty(t, client.sent)
+}
+
+func TestMutualNoKey(t *testing.T) {
+	m := newMutualSetup(t)
+
+	for _, role := range []Role{Client, Server} {
+		client, _ := newMessagePipe(nil, nil)
+
+		_, err := Mutual(client, Identity{Role: role, KeyID: "client"}, m.clientKeys)
+		assert.Equal(t, ErrNoKey, err)
+		assert.Empty(t, client.sent)
+	}
+}
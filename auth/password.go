@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Password authentication uses SPAKE2 (RFC 9382) on P-256 with SHA-256,
+// HKDF and HMAC. Each side sends a share blinded with the password, and
+// both derive a key that only matches if they used the same password.
+// They then exchange MACs under that key to prove it. An eavesdropper
+// learns nothing it can test password guesses against, and an active
+// attacker gets one guess per exchange.
+//
+// The client is A in RFC 9382 and the server is B. The identities are
+// the client's and the server's AuthToken, so the exchange only succeeds
+// between the two ends of the same seconn session. Messages go in this
+// order:
+//
+//   client -> server   share pA = x*G + w*M
+//   server -> client   share pB = y*G + w*N
+//   server -> client   confirmation cB
+//   client -> server   confirmation cA
+//
+// A side that gives up, because the peer's share or confirmation was
+// bad, sends a verdict of 0 in place of its confirmation so the peer
+// isn't left waiting for one.
+//
+// RFC 9382 leaves the memory hard function to the application. Ours is
+// w = HKDF-SHA256(password, no salt, "seconn spake2 password") taken to
+// 40 bytes, read big endian and reduced mod the group order. The rest is
+// as in the RFC. The transcript TT is the client token, server token,
+// pA, pB, K and w, each prefixed by its length as 8 bytes little endian,
+// with points uncompressed SEC1 and w 32 bytes big endian. Then
+//
+//   Ke || Ka   = SHA-256(TT)
+//   KcA || KcB = HKDF-SHA256(Ka, no salt, "ConfirmationKeys"), 16 bytes each
+//   cA         = HMAC-SHA256(KcA, TT)
+//   cB         = HMAC-SHA256(KcB, TT)
+//
+// The AAD is empty, and Ke goes unused since the seconn session already
+// has its own keys. testdata/spake2.json is generated by
+// testdata/spake2.py, which shares no code with this file.
+
+// Which end of the session we are. Exchanges that take turns use it to
+// agree on who goes first.
+type Role int
+
+const (
+	Client Role = iota + 1
+	Server
+)
+
+var (
+	ErrWrongPassword = errors.New("wrong password")
+	ErrUnknownRole   = errors.New("unknown role")
+)
+
+// The fixed points for P-256 from RFC 9382
+var (
+	spakeM = mustPoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	spakeN = mustPoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+)
+
+type point struct {
+	x, y *big.Int
+}
+
+func mustPoint(s string) point {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), data)
+	if x == nil {
+		panic("auth: invalid point " + s)
+	}
+
+	return point{x, y}
+}
+
+func (p point) bytes() []byte {
+	return elliptic.Marshal(elliptic.P256(), p.x, p.y)
+}
+
+func (p point) isIdentity() bool {
+	return p.x.Sign() == 0 && p.y.Sign() == 0
+}
+
+func scalarBytes(k *big.Int) []byte {
+	return k.FillBytes(make([]byte, 32))
+}
+
+// Reduce 40 bytes mod the group order, so the bias is negligible
+func reduceScalar(data []byte) *big.Int {
+	k := new(big.Int).SetBytes(data)
+	return k.Mod(k, elliptic.P256().Params().N)
+}
+
+func passwordScalar(password []byte) (*big.Int, error) {
+	buf := make([]byte, 40)
+
+	_, err := io.ReadFull(hkdf.New(sha256.New, password, nil, []byte("seconn spake2 password")), buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return reduceScalar(buf), nil
+}
+
+func randomScalar() (*big.Int, error) {
+	buf := make([]byte, 40)
+
+	for {
+		_, err := io.ReadFull(randReader, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		k := reduceScalar(buf)
+		if k.Sign() != 0 {
+			return k, nil
+		}
+	}
+}
+
+// One side of a SPAKE2 exchange
+type spake2 struct {
+	role  Role
+	w     *big.Int
+	x     *big.Int
+	share point
+
+	// The client's and server's AuthToken
+	idA, idB []byte
+}
+
+func newSpake2(conn MessageConnection, role Role, password []byte) (*spake2, error) {
+	s := &spake2{role: role}
+
+	switch role {
+	case Client:
+		s.idA, s.idB = conn.AuthToken(), conn.PeerAuthToken()
+	case Server:
+		s.idA, s.idB = conn.PeerAuthToken(), conn.AuthToken()
+	default:
+		return nil, ErrUnknownRole
+	}
+
+	var err error
+
+	s.w, err = passwordScalar(password)
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+
+	s.setScalar(x)
+
+	return s, nil
+}
+
+// Use x as our secret scalar and work out the share to send
+func (s *spake2) setScalar(x *big.Int) {
+	curve := elliptic.P256()
+
+	blind := spakeM
+	if s.role == Server {
+		blind = spakeN
+	}
+
+	gx, gy := curve.ScalarBaseMult(scalarBytes(x))
+	bx, by := curve.ScalarMult(blind.x, blind.y, scalarBytes(s.w))
+
+	s.x = x
+	s.share.x, s.share.y = curve.Add(gx, gy, bx, by)
+}
+
+// Work out the confirmation keys from the peer's share, returning ours
+// first.
+func (s *spake2) finish(peer []byte) (ours, theirs []byte, err error) {
+	curve := elliptic.P256()
+
+	var p point
+
+	p.x, p.y = elliptic.Unmarshal(curve, peer)
+	if p.x == nil {
+		return nil, nil, ErrMalformedMessage
+	}
+
+	// Take the password's blinding off the peer's share
+	blind := spakeN
+	if s.role == Server {
+		blind = spakeM
+	}
+
+	bx, by := curve.ScalarMult(blind.x, blind.y, scalarBytes(s.w))
+	by.Sub(curve.Params().P, by)
+
+	var k point
+
+	k.x, k.y = curve.Add(p.x, p.y, bx, by)
+	k.x, k.y = curve.ScalarMult(k.x, k.y, scalarBytes(s.x))
+
+	if k.isIdentity() {
+		return nil, nil, ErrWrongPassword
+	}
+
+	X, Y := s.share.bytes(), peer
+	if s.role == Server {
+		X, Y = Y, X
+	}
+
+	var tt []byte
+
+	for _, part := range [][]byte{s.idA, s.idB, X, Y, k.bytes(), scalarBytes(s.w)} {
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], uint64(len(part)))
+
+		tt = append(tt, size[:]...)
+		tt = append(tt, part...)
+	}
+
+	// Ke || Ka = Hash(TT)
+	digest := sha256.Sum256(tt)
+	ka := digest[16:]
+
+	keys := make([]byte, 32)
+
+	_, err = io.ReadFull(hkdf.New(sha256.New, ka, nil, []byte("ConfirmationKeys")), keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cA := hmac.New(sha256.New, keys[:16])
+	cA.Write(tt)
+
+	cB := hmac.New(sha256.New, keys[16:])
+	cB.Write(tt)
+
+	if s.role == Client {
+		return cA.Sum(nil), cB.Sum(nil), nil
+	}
+
+	return cB.Sum(nil), cA.Sum(nil), nil
+}
+
+// Prove to the peer that we know password and check that it does too.
+// role says which end of the seconn session conn is, and the peer must
+// use the other one. Nothing sent can be used to test password guesses
+// offline, so unlike SendSharedKey it's safe with low entropy passwords.
+func ExchangePassword(conn MessageConnection, role Role, password []byte) error {
+	s, err := newSpake2(conn, role, password)
+	if err != nil {
+		return err
+	}
+
+	var peer, ours, theirs []byte
+
+	if role == Client {
+		err = sendString(conn, msgPasswordShare, s.share.bytes(), maxShareSize)
+		if err != nil {
+			return err
+		}
+
+		peer, err = getString(conn, msgPasswordShare, maxShareSize)
+		if err != nil {
+			return err
+		}
+
+		ours, theirs, err = s.finish(peer)
+		if err != nil {
+			return rejectPassword(conn, err)
+		}
+
+		err = checkConfirmation(conn, theirs)
+		if err == ErrWrongPassword {
+			return rejectPassword(conn, err)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return sendString(conn, msgPasswordConfirm, ours, maxMACSize)
+	}
+
+	peer, err = getString(conn, msgPasswordShare, maxShareSize)
+	if err != nil {
+		return err
+	}
+
+	err = sendString(conn, msgPasswordShare, s.share.bytes(), maxShareSize)
+	if err != nil {
+		return err
+	}
+
+	ours, theirs, err = s.finish(peer)
+	if err != nil {
+		return rejectPassword(conn, err)
+	}
+
+	err = sendString(conn, msgPasswordConfirm, ours, maxMACSize)
+	if err != nil {
+		return err
+	}
+
+	return checkConfirmation(conn, theirs)
+}
+
+// Tell the peer we've given up, in place of our confirmation, and
+// return err.
+func rejectPassword(conn MessageConnection, err error) error {
+	sendErr := sendVerdict(conn, false)
+	if sendErr != nil {
+		return sendErr
+	}
+
+	return err
+}
+
+func checkConfirmation(conn MessageConnection, expected []byte) error {
+	msg, err := conn.GetMessage()
+	if err != nil {
+		return err
+	}
+
+	// The peer sends a verdict instead when it has given up
+	if messageType(msg) == msgVerdict {
+		_, err = parseVerdict(msg)
+		if err != nil {
+			return err
+		}
+
+		return ErrWrongPassword
+	}
+
+	r, err := openMessage(msg, msgPasswordConfirm)
+	if err != nil {
+		return err
+	}
+
+	confirm := r.string(maxMACSize)
+
+	err = r.finish()
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, confirm) {
+		return ErrWrongPassword
+	}
+
+	return nil
+}
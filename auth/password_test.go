@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// One end of an in memory session, delivering messages to the other end
+type messagePipe struct {
+	in, out          chan []byte
+	token, peerToken []byte
+
+	closeOnce sync.Once
+	sent      [][]byte
+}
+
+func newMessagePipe(clientToken, serverToken []byte) (client, server *messagePipe) {
+	a, b := make(chan []byte, 8), make(chan []byte, 8)
+
+	client = &messagePipe{in: b, out: a, token: clientToken, peerToken: serverToken}
+	server = &messagePipe{in: a, out: b, token: serverToken, peerToken: clientToken}
+
+	return client, server
+}
+
+func (p *messagePipe) GetMessage() ([]byte, error) {
+	msg, ok := <-p.in
+	if !ok {
+		return nil, io.EOF
+	}
+
+	return msg, nil
+}
+
+func (p *messagePipe) SendMessage(msg []byte) error {
+	msg = append([]byte(nil), msg...)
+
+	p.sent = append(p.sent, msg)
+	p.out <- msg
+
+	return nil
+}
+
+func (p *messagePipe) AuthToken() []byte     { return p.token }
+func (p *messagePipe) PeerAuthToken() []byte { return p.peerToken }
+
+// Tell the other end we're done, like closing the connection would
+func (p *messagePipe) Close() {
+	p.closeOnce.Do(func() { close(p.out) })
+}
+
+// Run fn for both ends at once, closing each end once its side is done
+func runPair(client, server *messagePipe, fn func(conn MessageConnection, role Role) error) (cerr, serr error) {
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer server.Close()
+
+		serr = fn(server, Server)
+	}()
+
+	cerr = fn(client, Client)
+	client.Close()
+
+	wg.Wait()
+
+	return cerr, serr
+}
+
+func messageTypes(msgs [][]byte) []byte {
+	var types []byte
+
+	for _, msg := range msgs {
+		types = append(types, msg[1])
+	}
+
+	return types
+}
+
+func TestExchangePassword(t *testing.T) {
+	client, server := newMessagePipe([]byte("client token"), []byte("server token"))
+
+	cerr, serr := runPair(client, server, func(conn MessageConnection, role Role) error {
+		return ExchangePassword(conn, role, []byte("hunter2"))
+	})
+
+	require.NoError(t, cerr)
+	require.NoError(t, serr)
+
+	// The password, or anything derived from it alone, is never sent
+	for _, msg := range append(client.sent, server.sent...) {
+		assert.False(t, bytes.Contains(msg, []byte("hunter2")))
+
+		w, err := passwordScalar([]byte("hunter2"))
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(msg, scalarBytes(w)))
+	}
+}
+
+func TestExchangePasswordWrongPassword(t *testing.T) {
+	client, server := newMessagePipe([]byte("client token"), []byte("server token"))
+
+	cerr, serr := runPair(client, server, func(conn MessageConnection, role Role) error {
+		if role == Client {
+			return ExchangePassword(conn, role, []byte("hunter2"))
+		}
+
+		return ExchangePassword(conn, role, []byte("hunter3"))
+	})
+
+	assert.Equal(t, ErrWrongPassword, cerr)
+	assert.Equal(t, ErrWrongPassword, serr)
+
+	// The server hears about it from the client, not the connection closing
+	assert.Equal(t, []byte{msgPasswordShare, msgVerdict}, messageTypes(client.sent))
+}
+
+func TestExchangePasswordDifferentSessions(t *testing.T) {
+	// A man in the middle has a different session with each side, so
+	// the tokens don't line up even when it relays every message.
+	client, server := newMessagePipe([]byte("client token"), []byte("server token"))
+	server.peerToken = []byte("other client token")
+
+	cerr, serr := runPair(client, server, func(conn MessageConnection, role Role) error {
+		return ExchangePassword(conn, role, []byte("hunter2"))
+	})
+
+	assert.Equal(t, ErrWrongPassword, cerr)
+	assert.Equal(t, ErrWrongPassword, serr)
+}
+
+func TestExchangePasswordSharesAreRandom(t *testing.T) {
+	var shares [][]byte
+
+	for i := 0; i < 2; i++ {
+		client, server := newMessagePipe([]byte("client token"), []byte("server token"))
+
+		_, _ = runPair(client, server, func(conn MessageConnection, role Role) error {
+			return ExchangePassword(conn, role, []byte("hunter2"))
+		})
+
+		shares = append(shares, client.sent[0])
+	}
+
+	assert.NotEqual(t, shares[0], shares[1])
+}
+
+func TestExchangePasswordBadShare(t *testing.T) {
+	client, server := newMessagePipe([]byte("client token"), []byte("server token"))
+
+	// Not a point on the curve, x is larger than the field
+	bad := bytes.Repeat([]byte{0xff}, 65)
+	bad[0] = 4
+
+	require.NoError(t, sendString(client, msgPasswordShare, bad, maxShareSize))
+	client.Close()
+
+	err := ExchangePassword(server, Server, []byte("hunter2"))
+	assert.Equal(t, ErrMalformedMessage, err)
+
+	// The client is told, rather than left waiting for a confirmation
+	assert.Equal(t, []byte{msgPasswordShare, msgVerdict}, messageTypes(server.sent))
+}
+
+func TestExchangePasswordUnknownRole(t *testing.T) {
+	client, _ := newMessagePipe(nil, nil)
+
+	err := ExchangePassword(client, 0, []byte("hunter2"))
+	assert.Equal(t, ErrUnknownRole, err)
+}
+
+type spake2Vector struct {
+	Password    string `json:"password"`
+	ClientToken string `json:"client_token"`
+	ServerToken string `json:"server_token"`
+	X           string `json:"x"`
+	Y           string `json:"y"`
+	W           string `json:"w"`
+	ClientShare string `json:"client_share"`
+	ServerShare string `json:"server_share"`
+	ClientMAC   string `json:"client_confirmation"`
+	ServerMAC   string `json:"server_confirmation"`
+}
+
+func TestSpake2Vector(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/spake2.json")
+	require.NoError(t, err)
+
+	var v spake2Vector
+	require.NoError(t, json.Unmarshal(data, &v))
+
+	client, server := newMessagePipe(unhex(t, v.ClientToken), unhex(t, v.ServerToken))
+
+	a, err := newSpake2(client, Client, []byte(v.Password))
+	require.NoError(t, err)
+
+	b, err := newSpake2(server, Server, []byte(v.Password))
+	require.NoError(t, err)
+
+	assert.Equal(t, unhex(t, v.W), scalarBytes(a.w))
+
+	a.setScalar(new(big.Int).SetBytes(unhex(t, v.X)))
+	b.setScalar(new(big.Int).SetBytes(unhex(t, v.Y)))
+
+	assert.Equal(t, unhex(t, v.ClientShare), a.share.bytes())
+	assert.Equal(t, unhex(t, v.ServerShare), b.share.bytes())
+
+	cA, cB, err := a.finish(b.share.bytes())
+	require.NoError(t, err)
+
+	assert.Equal(t, unhex(t, v.ClientMAC), cA)
+	assert.Equal(t, unhex(t, v.ServerMAC), cB)
+
+	ours, theirs, err := b.finish(a.share.bytes())
+	require.NoError(t, err)
+
+	assert.Equal(t, cB, ours)
+	assert.Equal(t, cA, theirs)
+}
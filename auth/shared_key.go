@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/gob"
 )
 
 type signedShared struct {
@@ -12,6 +11,10 @@ type signedShared struct {
 	Signature []byte
 }
 
+// Check the peer's MAC of its auth token under key.
+//
+// Deprecated: the MAC lets anyone who sees it test password guesses
+// offline. Use ExchangePassword instead.
 func VerifySharedKey(conn MessageConnection, key []byte) error {
 	msg, err := conn.GetMessage()
 	if err != nil {
@@ -20,7 +23,15 @@ func VerifySharedKey(conn MessageConnection, key []byte) error {
 
 	var signed signedShared
 
-	err = gob.NewDecoder(bytes.NewReader(msg)).Decode(&signed)
+	if isGob(conn) {
+		var old gobSignedShared
+
+		err = decodeGob(msg, &old)
+		signed = signedShared(old)
+	} else {
+		err = signed.unmarshal(msg)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -41,6 +52,10 @@ func VerifySharedKey(conn MessageConnection, key []byte) error {
 	return nil
 }
 
+// Send a MAC of our auth token under key.
+//
+// Deprecated: the MAC lets anyone who sees it test password guesses
+// offline. Use ExchangePassword instead.
 func SendSharedKey(conn MessageConnection, key []byte) error {
 	token := conn.AuthToken()
 
@@ -54,12 +69,20 @@ func SendSharedKey(conn MessageConnection, key []byte) error {
 		Signature: computed,
 	}
 
-	var msg1 bytes.Buffer
+	var (
+		msg1 []byte
+		err  error
+	)
+
+	if isGob(conn) {
+		msg1, err = encodeGob(gobSignedShared(signed))
+	} else {
+		msg1, err = signed.marshal()
+	}
 
-	err := gob.NewEncoder(&msg1).Encode(&signed)
 	if err != nil {
 		return err
 	}
 
-	return conn.SendMessage(msg1.Bytes())
+	return conn.SendMessage(msg1)
 }
@@ -1,15 +1,13 @@
 package auth
 
 import (
-	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/gob"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
-	"code.google.com/p/go.crypto/pbkdf2"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 func TestSharedKeyAuth(t *testing.T) {
@@ -30,12 +28,10 @@ func TestSharedKeyAuth(t *testing.T) {
 		Signature: hm.Sum(nil),
 	}
 
-	var msg1 bytes.Buffer
-
-	err := gob.NewEncoder(&msg1).Encode(&val1)
+	msg1, err := val1.marshal()
 	require.NoError(t, err)
 
-	client.On("GetMessage").Return(msg1.Bytes(), nil)
+	client.On("GetMessage").Return(msg1, nil)
 	client.On("PeerAuthToken").Return(token)
 
 	err = VerifySharedKey(&client, dk)
@@ -62,12 +58,10 @@ func TestSharedKeyAuthErrorsWithBadKey(t *testing.T) {
 		Signature: hm.Sum(nil),
 	}
 
-	var msg1 bytes.Buffer
-
-	err := gob.NewEncoder(&msg1).Encode(&val1)
+	msg1, err := val1.marshal()
 	require.NoError(t, err)
 
-	client.On("GetMessage").Return(msg1.Bytes(), nil)
+	client.On("GetMessage").Return(msg1, nil)
 	client.On("PeerAuthToken").Return(token)
 
 	err = VerifySharedKey(&client, dk[1:])
@@ -95,12 +89,10 @@ func TestSharedKeyAuthErrorsWithDifferentToken(t *testing.T) {
 		Signature: hm.Sum(nil),
 	}
 
-	var msg1 bytes.Buffer
-
-	err := gob.NewEncoder(&msg1).Encode(&val1)
+	msg1, err := val1.marshal()
 	require.NoError(t, err)
 
-	client.On("GetMessage").Return(msg1.Bytes(), nil)
+	client.On("GetMessage").Return(msg1, nil)
 	client.On("PeerAuthToken").Return(token2)
 
 	err = VerifySharedKey(&client, dk)
@@ -127,12 +119,10 @@ func TestSharedKeyServer(t *testing.T) {
 		Signature: hm.Sum(nil),
 	}
 
-	var msg1 bytes.Buffer
-
-	err := gob.NewEncoder(&msg1).Encode(&val1)
+	msg1, err := val1.marshal()
 	require.NoError(t, err)
 
-	server.On("SendMessage", msg1.Bytes()).Return(nil)
+	server.On("SendMessage", msg1).Return(nil)
 	server.On("AuthToken").Return(token1)
 
 	err = SendSharedKey(&server, dk)
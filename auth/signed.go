@@ -2,13 +2,15 @@ package auth
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"io"
 
-	"encoding/gob"
 	"errors"
-	"math/big"
 )
 
 var randReader io.Reader = rand.Reader
@@ -20,20 +22,57 @@ type MessageConnection interface {
 	PeerAuthToken() []byte
 }
 
+// Look up the public key a peer signs with. The key must be an
+// *ecdsa.PublicKey on P-256 or an ed25519.PublicKey.
 type KeyProvider interface {
-	GetKey(id string) (*ecdsa.PublicKey, error)
+	GetKey(id string) (crypto.PublicKey, error)
 }
 
 var (
-	ErrInvalidSignature = errors.New("invalid signature")
-	ErrWrongToken       = errors.New("wrong token")
+	ErrInvalidSignature  = errors.New("invalid signature")
+	ErrWrongToken        = errors.New("wrong token")
+	ErrUnsupportedKey    = errors.New("unsupported key type")
+	ErrAlgorithmMismatch = errors.New("signature algorithm doesn't match key")
+	ErrNoKey             = errors.New("no key to sign with")
 )
 
+// The signature algorithm a token was signed with
+type Algorithm uint8
+
+const (
+	// ECDSA on P-256 over the SHA-256 of the token, with an ASN.1
+	// DER encoded signature
+	ECDSAP256 Algorithm = iota + 1
+
+	// Ed25519, with the 64 byte signature from RFC 8032
+	Ed25519
+)
+
+// Return the algorithm signatures by key use
+func algorithmOf(key crypto.PublicKey) (Algorithm, error) {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return 0, ErrUnsupportedKey
+		}
+
+		return ECDSAP256, nil
+	case ed25519.PublicKey:
+		if len(key) != ed25519.PublicKeySize {
+			return 0, ErrUnsupportedKey
+		}
+
+		return Ed25519, nil
+	}
+
+	return 0, ErrUnsupportedKey
+}
+
 type signedToken struct {
-	Token      []byte
-	KeyID      string
-	SignatureR *big.Int
-	SignatureS *big.Int
+	Token     []byte
+	KeyID     string
+	Algorithm Algorithm
+	Signature []byte
 }
 
 func VerifySignedToken(conn MessageConnection, keys KeyProvider) error {
@@ -42,47 +81,108 @@ func VerifySignedToken(conn MessageConnection, keys KeyProvider) error {
 		return err
 	}
 
+	if isGob(conn) {
+		return verifyGobSignedToken(conn, msg, keys)
+	}
+
+	_, err = checkSignedToken(conn, msg, keys)
+	return err
+}
+
+// Check that msg is the peer's auth token signed with the key keys has
+// for it, returning who signed it.
+func checkSignedToken(conn MessageConnection, msg []byte, keys KeyProvider) (*PeerIdentity, error) {
 	var signed signedToken
 
-	err = gob.NewDecoder(bytes.NewReader(msg)).Decode(&signed)
+	err := signed.unmarshal(msg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !bytes.Equal(conn.PeerAuthToken(), signed.Token) {
-		return ErrWrongToken
+		return nil, ErrWrongToken
 	}
 
 	key, err := keys.GetKey(signed.KeyID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if !ecdsa.Verify(key, signed.Token, signed.SignatureR, signed.SignatureS) {
-		return ErrInvalidSignature
+	alg, err := algorithmOf(key)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
-}
+	// Never let the peer pick how its signature is checked
+	if alg != signed.Algorithm {
+		return nil, ErrAlgorithmMismatch
+	}
 
-func SendSignedToken(conn MessageConnection, id string, key *ecdsa.PrivateKey) error {
-	token := conn.AuthToken()
+	var ok bool
 
-	r, s, err := ecdsa.Sign(randReader, key, token)
+	switch alg {
+	case ECDSAP256:
+		sum := sha256.Sum256(signed.Token)
+		ok = ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), sum[:], signed.Signature)
+	case Ed25519:
+		ok = ed25519.Verify(key.(ed25519.PublicKey), signed.Token, signed.Signature)
+	}
 
-	signed := signedToken{
-		Token:      token,
-		KeyID:      id,
-		SignatureR: r,
-		SignatureS: s,
+	if !ok {
+		return nil, ErrInvalidSignature
 	}
 
-	var msg1 bytes.Buffer
+	return &PeerIdentity{KeyID: signed.KeyID, Key: key}, nil
+}
 
-	err = gob.NewEncoder(&msg1).Encode(&signed)
+// Sign our auth token with key and send it to the peer. key is usually
+// an *ecdsa.PrivateKey on P-256 or an ed25519.PrivateKey, but any
+// crypto.Signer with one of those public keys works.
+func SendSignedToken(conn MessageConnection, id string, key crypto.Signer) error {
+	if isGob(conn) {
+		return sendGobSignedToken(conn, id, key)
+	}
+
+	msg, err := signToken(conn, id, key)
 	if err != nil {
 		return err
 	}
 
-	return conn.SendMessage(msg1.Bytes())
+	return conn.SendMessage(msg)
+}
+
+// Build the message carrying our auth token signed with key
+func signToken(conn MessageConnection, id string, key crypto.Signer) ([]byte, error) {
+	if key == nil {
+		return nil, ErrNoKey
+	}
+
+	alg, err := algorithmOf(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	token := conn.AuthToken()
+
+	// Ed25519 signs the token itself, ECDSA its SHA-256 hash
+	msg, opts := token, crypto.SignerOpts(crypto.Hash(0))
+
+	if alg == ECDSAP256 {
+		sum := sha256.Sum256(token)
+		msg, opts = sum[:], crypto.SHA256
+	}
+
+	sig, err := key.Sign(randReader, msg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := signedToken{
+		Token:     token,
+		KeyID:     id,
+		Algorithm: alg,
+		Signature: sig,
+	}
+
+	return signed.marshal()
 }
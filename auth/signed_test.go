@@ -2,42 +2,46 @@ package auth
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
-	"encoding/gob"
-	"io"
-	"os"
+	"crypto/sha256"
 	"testing"
 
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
 func TestSignedTokenClient(t *testing.T) {
 	var client MockMessageConnection
 	var key MockKeyProvider
 
-	var msg1 bytes.Buffer
-
 	k1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	require.NoError(t, err)
 
 	token := []byte("aabbcc")
 
-	r, s, err := ecdsa.Sign(rand.Reader, k1, token)
+	sig, err := ecdsa.SignASN1(rand.Reader, k1, sha256Sum(token))
 	require.NoError(t, err)
 
 	val1 := signedToken{
-		Token:      token,
-		KeyID:      "k1",
-		SignatureR: r,
-		SignatureS: s,
+		Token:     token,
+		KeyID:     "k1",
+		Algorithm: ECDSAP256,
+		Signature: sig,
 	}
 
-	err = gob.NewEncoder(&msg1).Encode(&val1)
+	msg1, err := val1.marshal()
 	require.NoError(t, err)
 
-	client.On("GetMessage").Return(msg1.Bytes(), nil)
+	client.On("GetMessage").Return(msg1, nil)
 	client.On("PeerAuthToken").Return(token)
 
 	key.On("GetKey", "k1").Return(&k1.PublicKey, nil)
@@ -53,8 +57,6 @@ func TestSignedTokenClientDifferentKeyUsed(t *testing.T) {
 	var client MockMessageConnection
 	var key MockKeyProvider
 
-	var msg1 bytes.Buffer
-
 	k1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	require.NoError(t, err)
 
@@ -63,20 +65,20 @@ func TestSignedTokenClientDifferentKeyUsed(t *testing.T) {
 
 	token := []byte("aabbcc")
 
-	r, s, err := ecdsa.Sign(rand.Reader, k2, token)
+	sig, err := ecdsa.SignASN1(rand.Reader, k2, sha256Sum(token))
 	require.NoError(t, err)
 
 	val1 := signedToken{
-		Token:      token,
-		KeyID:      "k1",
-		SignatureR: r,
-		SignatureS: s,
+		Token:     token,
+		KeyID:     "k1",
+		Algorithm: ECDSAP256,
+		Signature: sig,
 	}
 
-	err = gob.NewEncoder(&msg1).Encode(&val1)
+	msg1, err := val1.marshal()
 	require.NoError(t, err)
 
-	client.On("GetMessage").Return(msg1.Bytes(), nil)
+	client.On("GetMessage").Return(msg1, nil)
 	client.On("PeerAuthToken").Return(token)
 
 	key.On("GetKey", "k1").Return(&k1.PublicKey, nil)
@@ -92,28 +94,26 @@ func TestSignedTokenClientDifferentTokenPassed(t *testing.T) {
 	var client MockMessageConnection
 	var key MockKeyProvider
 
-	var msg1 bytes.Buffer
-
 	k2, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	require.NoError(t, err)
 
 	token1 := []byte("aabbcc")
 	token2 := []byte("ddeeff")
 
-	r, s, err := ecdsa.Sign(rand.Reader, k2, token2)
+	sig, err := ecdsa.SignASN1(rand.Reader, k2, sha256Sum(token2))
 	require.NoError(t, err)
 
 	val1 := signedToken{
-		Token:      token2,
-		KeyID:      "k1",
-		SignatureR: r,
-		SignatureS: s,
+		Token:     token2,
+		KeyID:     "k1",
+		Algorithm: ECDSAP256,
+		Signature: sig,
 	}
 
-	err = gob.NewEncoder(&msg1).Encode(&val1)
+	msg1, err := val1.marshal()
 	require.NoError(t, err)
 
-	client.On("GetMessage").Return(msg1.Bytes(), nil)
+	client.On("GetMessage").Return(msg1, nil)
 	client.On("PeerAuthToken").Return(token1)
 
 	err = VerifySignedToken(&client, &key)
@@ -126,44 +126,167 @@ func TestSignedTokenClientDifferentTokenPassed(t *testing.T) {
 func TestSignedTokenServer(t *testing.T) {
 	var server MockMessageConnection
 
-	var old io.Reader
+	token1 := []byte("aabbcc")
 
-	zero, err := os.Open("/dev/zero")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	require.NoError(t, err)
 
-	defer zero.Close()
+	// ECDSA signatures are randomized, so check the one sent verifies
+	signed := mock.MatchedBy(func(msg []byte) bool {
+		var val signedToken
 
-	old, randReader = randReader, zero
+		if val.unmarshal(msg) != nil {
+			return false
+		}
 
-	defer func() {
-		randReader = old
-	}()
+		return bytes.Equal(val.Token, token1) &&
+			val.KeyID == "k1" &&
+			val.Algorithm == ECDSAP256 &&
+			ecdsa.VerifyASN1(&key.PublicKey, sha256Sum(token1), val.Signature)
+	})
 
-	token1 := []byte("aabbcc")
+	server.On("SendMessage", signed).Return(nil)
+	server.On("AuthToken").Return(token1)
 
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	err = SendSignedToken(&server, "k1", key)
 	require.NoError(t, err)
 
-	r, s, err := ecdsa.Sign(randReader, key, token1)
+	server.AssertExpectations(t)
+}
+
+func TestSignedTokenEd25519(t *testing.T) {
+	var client MockMessageConnection
+	var key MockKeyProvider
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
 	require.NoError(t, err)
 
+	token := []byte("aabbcc")
+
 	val1 := signedToken{
-		Token:      token1,
-		KeyID:      "k1",
-		SignatureR: r,
-		SignatureS: s,
+		Token:     token,
+		KeyID:     "k1",
+		Algorithm: Ed25519,
+		Signature: ed25519.Sign(priv, token),
 	}
 
-	var msg1 bytes.Buffer
+	msg1, err := val1.marshal()
+	require.NoError(t, err)
+
+	client.On("GetMessage").Return(msg1, nil)
+	client.On("PeerAuthToken").Return(token)
+
+	key.On("GetKey", "k1").Return(pub, nil)
 
-	err = gob.NewEncoder(&msg1).Encode(&val1)
+	err = VerifySignedToken(&client, &key)
 	require.NoError(t, err)
 
-	server.On("SendMessage", msg1.Bytes()).Return(nil)
-	server.On("AuthToken").Return(token1)
+	client.AssertExpectations(t)
+	key.AssertExpectations(t)
+}
 
-	err = SendSignedToken(&server, "k1", key)
+func TestSignedTokenAlgorithmMismatch(t *testing.T) {
+	k1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
 	require.NoError(t, err)
 
+	token := []byte("aabbcc")
+
+	sig, err := ecdsa.SignASN1(rand.Reader, k1, sha256Sum(token))
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		alg Algorithm
+		key crypto.PublicKey
+	}{
+		"ecdsa signature, ed25519 key": {ECDSAP256, pub},
+		"ed25519 claimed, ecdsa key":   {Ed25519, &k1.PublicKey},
+		"no algorithm":                 {0, &k1.PublicKey},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			var client MockMessageConnection
+			var key MockKeyProvider
+
+			val1 := signedToken{
+				Token:     token,
+				KeyID:     "k1",
+				Algorithm: c.alg,
+				Signature: sig,
+			}
+
+			msg1, err := val1.marshal()
+			require.NoError(t, err)
+
+			client.On("GetMessage").Return(msg1, nil)
+			client.On("PeerAuthToken").Return(token)
+
+			key.On("GetKey", "k1").Return(c.key, nil)
+
+			err = VerifySignedToken(&client, &key)
+			require.Equal(t, ErrAlgorithmMismatch, err)
+		})
+	}
+}
+
+func TestSignedTokenUnsupportedKey(t *testing.T) {
+	var server MockMessageConnection
+
+	k1, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	err = SendSignedToken(&server, "k1", k1)
+	require.Equal(t, ErrUnsupportedKey, err)
+
 	server.AssertExpectations(t)
 }
+
+func TestSignedTokenRoundTrip(t *testing.T) {
+	k1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signers := map[string]struct {
+		signer crypto.Signer
+		key    crypto.PublicKey
+	}{
+		"ecdsa":   {k1, &k1.PublicKey},
+		"ed25519": {priv, pub},
+	}
+
+	for name, c := range signers {
+		t.Run(name, func(t *testing.T) {
+			var server, client MockMessageConnection
+			var key MockKeyProvider
+
+			token := []byte("aabbcc")
+
+			var sent []byte
+
+			server.On("AuthToken").Return(token)
+			server.On("SendMessage", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+				sent = args.Get(0).([]byte)
+			})
+
+			err := SendSignedToken(&server, "k1", c.signer)
+			require.NoError(t, err)
+
+			client.On("GetMessage").Return(sent, nil)
+			client.On("PeerAuthToken").Return(token)
+
+			key.On("GetKey", "k1").Return(c.key, nil)
+
+			err = VerifySignedToken(&client, &key)
+			require.NoError(t, err)
+
+			server.AssertExpectations(t)
+			client.AssertExpectations(t)
+			key.AssertExpectations(t)
+		})
+	}
+}
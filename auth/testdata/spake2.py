@@ -0,0 +1,138 @@
+#!/usr/bin/env python3
+# Generates spake2.json from RFC 9382 directly, without sharing any code
+# with the Go implementation, so the vector checks more than itself.
+#
+#   python3 spake2.py > spake2.json
+
+import hashlib
+import hmac
+import json
+
+# P-256
+p = 0xffffffff00000001000000000000000000000000ffffffffffffffffffffffff
+a = p - 3
+b = 0x5ac635d8aa3a93e7b3ebbd55769886bc651d06b0cc53b0f63bce3c3e27d2604b
+n = 0xffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551
+G = (0x6b17d1f2e12c4247f8bce6e563a440f277037d812deb33a0f4a13945d898c296,
+     0x4fe342e2fe1a7f9b8ee7eb4a7c0f9e162bce33576b315ececbb6406837bf51f5)
+
+
+def add(P, Q):
+    if P is None:
+        return Q
+    if Q is None:
+        return P
+    if P[0] == Q[0]:
+        if (P[1] + Q[1]) % p == 0:
+            return None
+        l = (3 * P[0] * P[0] + a) * pow(2 * P[1], -1, p) % p
+    else:
+        l = (Q[1] - P[1]) * pow(Q[0] - P[0], -1, p) % p
+    x = (l * l - P[0] - Q[0]) % p
+    return (x, (l * (P[0] - x) - P[1]) % p)
+
+
+def mul(k, P):
+    R = None
+    while k:
+        if k & 1:
+            R = add(R, P)
+        P = add(P, P)
+        k >>= 1
+    return R
+
+
+def neg(P):
+    return (P[0], -P[1] % p)
+
+
+def decompress(s):
+    x = int.from_bytes(s[1:], 'big')
+    y2 = (x * x * x + a * x + b) % p
+    y = pow(y2, (p + 1) // 4, p)
+    assert y * y % p == y2
+    if y & 1 != s[0] & 1:
+        y = p - y
+    return (x, y)
+
+
+def encode(P):
+    return b'\x04' + P[0].to_bytes(32, 'big') + P[1].to_bytes(32, 'big')
+
+
+# Section 6 of RFC 9382: hash the seed until it gives the x coordinate
+# of a point, so nobody knows the discrete log of M or N.
+def seed_point(name):
+    seed = ('1.2.840.10045.3.1.7 point generation seed (%s)' % name).encode()
+
+    for i in range(1, 1000):
+        h = seed
+        for _ in range(i):
+            h = hashlib.sha256(h).digest()
+        h += hashlib.sha256(h).digest()
+
+        s = bytes([h[0] & 1 | 2]) + h[1:33]
+        if int.from_bytes(s[1:], 'big') >= p:
+            continue
+        try:
+            return s, decompress(s)
+        except AssertionError:
+            pass
+
+
+M_bytes, M = seed_point('M')
+N_bytes, N = seed_point('N')
+
+assert M_bytes.hex() == '02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f'
+assert N_bytes.hex() == '03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49'
+
+
+def hkdf(ikm, salt, info, size):
+    prk = hmac.new(salt or bytes(32), ikm, hashlib.sha256).digest()
+    out, t, i = b'', b'', 1
+    while len(out) < size:
+        t = hmac.new(prk, t + info + bytes([i]), hashlib.sha256).digest()
+        out += t
+        i += 1
+    return out[:size]
+
+
+def prefixed(*parts):
+    return b''.join(len(part).to_bytes(8, 'little') + part for part in parts)
+
+
+password = b'password'
+idA = bytes(range(0x00, 0x20))
+idB = bytes(range(0x80, 0xa0))
+x = int('11' * 32, 16)
+y = int('22' * 32, 16)
+
+# seconn's choice of memory hard function is HKDF, reduced from 40 bytes
+w = int.from_bytes(hkdf(password, None, b'seconn spake2 password', 40), 'big') % n
+
+pA = add(mul(x, G), mul(w, M))
+pB = add(mul(y, G), mul(w, N))
+
+K = mul(x, add(pB, neg(mul(w, N))))
+assert K == mul(y, add(pA, neg(mul(w, M))))
+
+TT = prefixed(idA, idB, encode(pA), encode(pB), encode(K), w.to_bytes(32, 'big'))
+
+digest = hashlib.sha256(TT).digest()
+Ke, Ka = digest[:16], digest[16:]
+
+keys = hkdf(Ka, None, b'ConfirmationKeys', 32)
+KcA, KcB = keys[:16], keys[16:]
+
+print(json.dumps({
+    'password': password.decode(),
+    'client_token': idA.hex(),
+    'server_token': idB.hex(),
+    'x': '%064x' % x,
+    'y': '%064x' % y,
+    'w': '%064x' % w,
+    'client_share': encode(pA).hex(),
+    'server_share': encode(pB).hex(),
+    'client_confirmation': hmac.new(KcA, TT, hashlib.sha256).hexdigest(),
+    'server_confirmation': hmac.new(KcB, TT, hashlib.sha256).hexdigest(),
+}, indent=2))
@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Auth messages use a small binary format that's easy to produce and
+// parse outside of Go. Every message starts with two bytes, the format
+// version (currently 1) and the message type, followed by the message's
+// fields in a fixed order. A byte field is a single byte. A string field
+// is a 2 byte big endian length followed by that many bytes.
+//
+// Signed token, type 1:
+//
+//   algorithm  byte     1 = ECDSA P-256, 2 = Ed25519
+//   token      string   at most 64 bytes
+//   key id     string   at most 255 bytes
+//   signature  string   at most 128 bytes
+//
+// Shared key, type 2:
+//
+//   token      string   at most 64 bytes
+//   mac        string   at most 64 bytes
+//
+// Password share, type 3:
+//
+//   share      string   uncompressed P-256 point, 65 bytes
+//
+// Password confirmation, type 4:
+//
+//   mac        string   at most 64 bytes
+//
+// Verdict, type 5:
+//
+//   accepted   byte     1 if the peer's proof checked out, otherwise 0
+//
+// ExchangePassword also sends a verdict of 0 in place of a password
+// confirmation when it gives up.
+//
+// A message is rejected if it's longer than 1024 bytes, has an unknown
+// version, has the wrong type, has a field over its limit or has bytes
+// left over after the last field. testdata/vectors.json has examples.
+
+const wireVersion = 1
+
+const (
+	msgSignedToken byte = iota + 1
+	msgSharedKey
+	msgPasswordShare
+	msgPasswordConfirm
+	msgVerdict
+)
+
+const (
+	maxMessageSize   = 1024
+	maxTokenSize     = 64
+	maxKeyIDSize     = 255
+	maxSignatureSize = 128
+	maxMACSize       = 64
+	maxShareSize     = 65
+)
+
+var (
+	ErrMalformedMessage   = errors.New("malformed auth message")
+	ErrUnsupportedVersion = errors.New("unsupported auth message version")
+	ErrMessageTooLarge    = errors.New("auth message field too large")
+)
+
+// Builds a message, remembering the first field that didn't fit
+type wireWriter struct {
+	buf []byte
+	err error
+}
+
+func newMessage(typ byte) *wireWriter {
+	return &wireWriter{buf: []byte{wireVersion, typ}}
+}
+
+func (w *wireWriter) byte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+func (w *wireWriter) string(data []byte, max int) {
+	if len(data) > max {
+		w.err = ErrMessageTooLarge
+		return
+	}
+
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(data)))
+
+	w.buf = append(w.buf, size[:]...)
+	w.buf = append(w.buf, data...)
+}
+
+func (w *wireWriter) finish() ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	return w.buf, nil
+}
+
+// Takes a message apart. Once a field fails to parse, every later one
+// comes back empty and finish reports the problem.
+type wireReader struct {
+	data []byte
+	err  error
+}
+
+func openMessage(msg []byte, typ byte) (*wireReader, error) {
+	if len(msg) < 2 || len(msg) > maxMessageSize {
+		return nil, ErrMalformedMessage
+	}
+
+	if msg[0] != wireVersion {
+		return nil, ErrUnsupportedVersion
+	}
+
+	if msg[1] != typ {
+		return nil, ErrMalformedMessage
+	}
+
+	return &wireReader{data: msg[2:]}, nil
+}
+
+// The type of msg, or 0 if it's too short to have one
+func messageType(msg []byte) byte {
+	if len(msg) < 2 {
+		return 0
+	}
+
+	return msg[1]
+}
+
+func (r *wireReader) byte() byte {
+	if r.err != nil || len(r.data) < 1 {
+		r.err = ErrMalformedMessage
+		return 0
+	}
+
+	b := r.data[0]
+	r.data = r.data[1:]
+
+	return b
+}
+
+func (r *wireReader) string(max int) []byte {
+	if r.err != nil || len(r.data) < 2 {
+		r.err = ErrMalformedMessage
+		return nil
+	}
+
+	size := int(binary.BigEndian.Uint16(r.data))
+
+	if size > max || size > len(r.data)-2 {
+		r.err = ErrMalformedMessage
+		return nil
+	}
+
+	data := r.data[2 : 2+size]
+	r.data = r.data[2+size:]
+
+	return data
+}
+
+func (r *wireReader) finish() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	if len(r.data) != 0 {
+		return ErrMalformedMessage
+	}
+
+	return nil
+}
+
+func (s *signedToken) marshal() ([]byte, error) {
+	w := newMessage(msgSignedToken)
+
+	w.byte(byte(s.Algorithm))
+	w.string(s.Token, maxTokenSize)
+	w.string([]byte(s.KeyID), maxKeyIDSize)
+	w.string(s.Signature, maxSignatureSize)
+
+	return w.finish()
+}
+
+func (s *signedToken) unmarshal(msg []byte) error {
+	r, err := openMessage(msg, msgSignedToken)
+	if err != nil {
+		return err
+	}
+
+	s.Algorithm = Algorithm(r.byte())
+	s.Token = r.string(maxTokenSize)
+	s.KeyID = string(r.string(maxKeyIDSize))
+	s.Signature = r.string(maxSignatureSize)
+
+	return r.finish()
+}
+
+func (s *signedShared) marshal() ([]byte, error) {
+	w := newMessage(msgSharedKey)
+
+	w.string(s.Token, maxTokenSize)
+	w.string(s.Signature, maxMACSize)
+
+	return w.finish()
+}
+
+func (s *signedShared) unmarshal(msg []byte) error {
+	r, err := openMessage(msg, msgSharedKey)
+	if err != nil {
+		return err
+	}
+
+	s.Token = r.string(maxTokenSize)
+	s.Signature = r.string(maxMACSize)
+
+	return r.finish()
+}
+
+// Send a message whose only field is data
+func sendString(conn MessageConnection, typ byte, data []byte, max int) error {
+	w := newMessage(typ)
+
+	w.string(data, max)
+
+	msg, err := w.finish()
+	if err != nil {
+		return err
+	}
+
+	return conn.SendMessage(msg)
+}
+
+// Read a message whose only field is a string
+func getString(conn MessageConnection, typ byte, max int) ([]byte, error) {
+	msg, err := conn.GetMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := openMessage(msg, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	data := r.string(max)
+
+	return data, r.finish()
+}
+
+func sendVerdict(conn MessageConnection, accepted bool) error {
+	w := newMessage(msgVerdict)
+
+	if accepted {
+		w.byte(1)
+	} else {
+		w.byte(0)
+	}
+
+	msg, err := w.finish()
+	if err != nil {
+		return err
+	}
+
+	return conn.SendMessage(msg)
+}
+
+func getVerdict(conn MessageConnection) (bool, error) {
+	msg, err := conn.GetMessage()
+	if err != nil {
+		return false, err
+	}
+
+	return parseVerdict(msg)
+}
+
+func parseVerdict(msg []byte) (bool, error) {
+	r, err := openMessage(msg, msgVerdict)
+	if err != nil {
+		return false, err
+	}
+
+	verdict := r.byte()
+
+	err = r.finish()
+	if err != nil {
+		return false, err
+	}
+
+	switch verdict {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	}
+
+	return false, ErrMalformedMessage
+}
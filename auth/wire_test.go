@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The vectors are meant for other implementations too, so everything in
+// them is plain JSON with hex encoded bytes.
+type wireVector struct {
+	Name      string
+	Type      string
+	Message   string
+	Error     string
+	Algorithm Algorithm
+	Token     string
+	KeyID     string `json:"key_id"`
+	Signature string
+	PublicKey string `json:"public_key"`
+	MAC       string
+	Key       string
+	Share     string
+	Accepted  bool
+}
+
+func loadVectors(t *testing.T) (valid, invalid []wireVector) {
+	data, err := ioutil.ReadFile("testdata/vectors.json")
+	require.NoError(t, err)
+
+	var vectors struct {
+		Valid   []wireVector
+		Invalid []wireVector
+	}
+
+	require.NoError(t, json.Unmarshal(data, &vectors))
+
+	return vectors.Valid, vectors.Invalid
+}
+
+func unhex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	require.NoError(t, err)
+
+	return data
+}
+
+func TestWireVectors(t *testing.T) {
+	valid, _ := loadVectors(t)
+
+	for _, v := range valid {
+		v := v
+
+		t.Run(v.Name, func(t *testing.T) {
+			msg := unhex(t, v.Message)
+			token := unhex(t, v.Token)
+
+			var client MockMessageConnection
+
+			client.On("GetMessage").Return(msg, nil)
+			client.On("PeerAuthToken").Return(token)
+
+			switch v.Type {
+			case "signed_token":
+				var signed signedToken
+				require.NoError(t, signed.unmarshal(msg))
+
+				assert.Equal(t, v.Algorithm, signed.Algorithm)
+				assert.Equal(t, token, signed.Token)
+				assert.Equal(t, v.KeyID, signed.KeyID)
+				assert.Equal(t, unhex(t, v.Signature), signed.Signature)
+
+				out, err := signed.marshal()
+				require.NoError(t, err)
+				assert.Equal(t, msg, out)
+
+				pub, err := parsePublicKey(unhex(t, v.PublicKey))
+				require.NoError(t, err)
+
+				var key MockKeyProvider
+				key.On("GetKey", v.KeyID).Return(pub, nil)
+
+				require.NoError(t, VerifySignedToken(&client, &key))
+			case "shared_key":
+				var signed signedShared
+				require.NoError(t, signed.unmarshal(msg))
+
+				assert.Equal(t, token, signed.Token)
+				assert.Equal(t, unhex(t, v.MAC), signed.Signature)
+
+				out, err := signed.marshal()
+				require.NoError(t, err)
+				assert.Equal(t, msg, out)
+
+				require.NoError(t, VerifySharedKey(&client, unhex(t, v.Key)))
+			case "password_share":
+				share, err := getString(&client, msgPasswordShare, maxShareSize)
+				require.NoError(t, err)
+				assert.Equal(t, unhex(t, v.Share), share)
+
+				var out MockMessageConnection
+				out.On("SendMessage", msg).Return(nil)
+
+				require.NoError(t, sendString(&out, msgPasswordShare, share, maxShareSize))
+				out.AssertExpectations(t)
+			case "password_confirmation":
+				mac := unhex(t, v.MAC)
+
+				require.NoError(t, checkConfirmation(&client, mac))
+
+				var out MockMessageConnection
+				out.On("SendMessage", msg).Return(nil)
+
+				require.NoError(t, sendString(&out, msgPasswordConfirm, mac, maxMACSize))
+				out.AssertExpectations(t)
+			case "verdict":
+				accepted, err := getVerdict(&client)
+				require.NoError(t, err)
+				assert.Equal(t, v.Accepted, accepted)
+
+				var out MockMessageConnection
+				out.On("SendMessage", msg).Return(nil)
+
+				require.NoError(t, sendVerdict(&out, accepted))
+				out.AssertExpectations(t)
+			default:
+				t.Fatalf("unknown message type %s", v.Type)
+			}
+		})
+	}
+}
+
+func TestWireVectorsInvalid(t *testing.T) {
+	_, invalid := loadVectors(t)
+
+	errs := map[string]error{
+		"malformed": ErrMalformedMessage,
+		"version":   ErrUnsupportedVersion,
+	}
+
+	for _, v := range invalid {
+		v := v
+
+		t.Run(v.Name, func(t *testing.T) {
+			msg := unhex(t, v.Message)
+
+			var err error
+
+			switch v.Type {
+			case "signed_token":
+				err = new(signedToken).unmarshal(msg)
+			case "shared_key":
+				err = new(signedShared).unmarshal(msg)
+			case "password_share", "password_confirmation":
+				typ := msgPasswordShare
+				max := maxShareSize
+
+				if v.Type == "password_confirmation" {
+					typ = msgPasswordConfirm
+					max = maxMACSize
+				}
+
+				var client MockMessageConnection
+				client.On("GetMessage").Return(msg, nil)
+
+				_, err = getString(&client, typ, max)
+			case "verdict":
+				_, err = parseVerdict(msg)
+			default:
+				t.Fatalf("unknown message type %s", v.Type)
+			}
+
+			assert.Equal(t, errs[v.Error], err)
+		})
+	}
+}
+
+func TestWireFieldTooLarge(t *testing.T) {
+	signed := signedToken{
+		Token:     make([]byte, 32),
+		KeyID:     string(make([]byte, maxKeyIDSize+1)),
+		Algorithm: Ed25519,
+	}
+
+	_, err := signed.marshal()
+	assert.Equal(t, ErrMessageTooLarge, err)
+}
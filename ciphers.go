@@ -0,0 +1,123 @@
+package seconn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"sync"
+
+	"github.com/vektra/errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Identifiers for the builtin cipher suites. These values are sent over
+// the wire during Negotiate.
+const (
+	AES128GCM        uint16 = 0x0001
+	AES256GCM        uint16 = 0x0002
+	ChaCha20Poly1305 uint16 = 0x0003
+)
+
+// The cipher suites offered when a Config doesn't set CipherSuites,
+// in order of preference.
+var DefaultCipherSuites = []uint16{AES128GCM, AES256GCM, ChaCha20Poly1305}
+
+var ErrNoCipherSuite = errors.New("no cipher suite in common with peer")
+
+var ErrUnknownCipherSuite = errors.New("unknown cipher suite")
+
+// A CipherSuite describes an AEAD that can be used to protect the records
+// sent over a Conn.
+type CipherSuite struct {
+	// The identifier sent over the wire
+	ID uint16
+
+	// A human readable name, used for logging
+	Name string
+
+	// The size of the key passed to New
+	KeySize int
+
+	// Create the AEAD from a key of KeySize bytes
+	New func(key []byte) (cipher.AEAD, error)
+}
+
+var (
+	cipherSuitesLock sync.RWMutex
+	cipherSuites     = map[uint16]*CipherSuite{}
+)
+
+func init() {
+	RegisterCipherSuite(&CipherSuite{
+		ID:      AES128GCM,
+		Name:    "AES-128-GCM",
+		KeySize: 16,
+		New:     newGCM,
+	})
+
+	RegisterCipherSuite(&CipherSuite{
+		ID:      AES256GCM,
+		Name:    "AES-256-GCM",
+		KeySize: 32,
+		New:     newGCM,
+	})
+
+	RegisterCipherSuite(&CipherSuite{
+		ID:      ChaCha20Poly1305,
+		Name:    "ChaCha20-Poly1305",
+		KeySize: chacha20poly1305.KeySize,
+		New:     chacha20poly1305.New,
+	})
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Make a cipher suite available to Negotiate. Registering a suite with
+// the ID of an existing one replaces it.
+func RegisterCipherSuite(cs *CipherSuite) {
+	cipherSuitesLock.Lock()
+	defer cipherSuitesLock.Unlock()
+
+	cipherSuites[cs.ID] = cs
+}
+
+// Lookup a registered cipher suite. Returns nil if id is unknown.
+func CipherSuiteByID(id uint16) *CipherSuite {
+	cipherSuitesLock.RLock()
+	defer cipherSuitesLock.RUnlock()
+
+	return cipherSuites[id]
+}
+
+// Return the name of the cipher suite with the given id
+func CipherSuiteName(id uint16) string {
+	if cs := CipherSuiteByID(id); cs != nil {
+		return cs.Name
+	}
+
+	return "unknown"
+}
+
+// Pick the first suite in prefs that also appears in offered.
+func selectCipherSuite(prefs, offered []uint16) (*CipherSuite, error) {
+	for _, id := range prefs {
+		for _, o := range offered {
+			if id != o {
+				continue
+			}
+
+			if cs := CipherSuiteByID(id); cs != nil {
+				return cs, nil
+			}
+		}
+	}
+
+	return nil, ErrNoCipherSuite
+}
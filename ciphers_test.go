@@ -0,0 +1,173 @@
+package seconn
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectCipherSuite(t *testing.T) {
+	cs, err := selectCipherSuite(
+		[]uint16{AES256GCM, ChaCha20Poly1305},
+		[]uint16{ChaCha20Poly1305, AES128GCM, AES256GCM},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, AES256GCM, cs.ID)
+
+	cs, err = selectCipherSuite(
+		[]uint16{AES256GCM, ChaCha20Poly1305},
+		[]uint16{AES128GCM, ChaCha20Poly1305},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, ChaCha20Poly1305, cs.ID)
+
+	_, err = selectCipherSuite([]uint16{AES256GCM}, []uint16{AES128GCM, 0x7777})
+	assert.Equal(t, ErrNoCipherSuite, err)
+}
+
+func TestCipherSuiteName(t *testing.T) {
+	assert.Equal(t, "AES-128-GCM", CipherSuiteName(AES128GCM))
+	assert.Equal(t, "AES-256-GCM", CipherSuiteName(AES256GCM))
+	assert.Equal(t, "ChaCha20-Poly1305", CipherSuiteName(ChaCha20Poly1305))
+	assert.Equal(t, "unknown", CipherSuiteName(0x7777))
+}
+
+func TestCipherSuitesRoundTrip(t *testing.T) {
+	for _, id := range DefaultCipherSuites {
+		t.Run(CipherSuiteName(id), func(t *testing.T) {
+			cfg := &Config{CipherSuites: []uint16{id}}
+
+			msgs := []string{"hello 1", "hello 2", "hello 3", "hello 4"}
+
+			l, err := net.Listen("tcp", ":0")
+			assert.NoError(t, err)
+			defer l.Close()
+
+			var wg sync.WaitGroup
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				o, err := l.Accept()
+				defer o.Close()
+
+				wo, err := NewServer(o, cfg)
+				assert.NoError(t, err)
+				assert.Equal(t, id, wo.CipherSuite())
+
+				buf := make([]byte, 7)
+
+				for i, msg := range msgs {
+					n, err := wo.Read(buf)
+					assert.NoError(t, err)
+					assert.Equal(t, msg, string(buf[:n]))
+
+					n, err = wo.Write(buf[:n])
+					assert.NoError(t, err)
+					assert.Equal(t, 7, n)
+
+					// Leave the last exchange alone so that the client
+					// isn't answering a rekey after we've hung up
+					if i < len(msgs)-2 {
+						wo.RekeyNext()
+					}
+				}
+			}()
+
+			c, err := net.Dial("tcp", l.Addr().String())
+			defer c.Close()
+
+			wc, err := NewClient(c, cfg)
+			assert.NoError(t, err)
+			assert.Equal(t, id, wc.CipherSuite())
+
+			firstKey := make([]byte, 32)
+			copy(firstKey, (*wc.shared)[:])
+
+			buf := make([]byte, 7)
+
+			for _, msg := range msgs {
+				n, err := wc.Write([]byte(msg))
+				assert.NoError(t, err)
+				assert.Equal(t, 7, n)
+
+				n, err = wc.Read(buf)
+				assert.NoError(t, err)
+				assert.Equal(t, msg, string(buf[:n]))
+			}
+
+			wg.Wait()
+
+			assert.NotEqual(t, firstKey, (*wc.shared)[:])
+		})
+	}
+}
+
+func TestCipherSuitesServerPreferenceWins(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		o, err := l.Accept()
+		defer o.Close()
+
+		wo, err := NewServer(o, &Config{
+			CipherSuites: []uint16{AES256GCM, ChaCha20Poly1305},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, ChaCha20Poly1305, wo.CipherSuite())
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	defer c.Close()
+
+	wc, err := NewClient(c, &Config{
+		CipherSuites: []uint16{AES128GCM, ChaCha20Poly1305},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ChaCha20Poly1305, wc.CipherSuite())
+
+	wg.Wait()
+}
+
+func TestCipherSuitesNoneInCommon(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		o, err := l.Accept()
+		defer o.Close()
+
+		wo, err := NewConn(o, &Config{CipherSuites: []uint16{AES256GCM}})
+		assert.NoError(t, err)
+
+		err = wo.Negotiate(true)
+		assert.Equal(t, ErrNoCipherSuite, err)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	defer c.Close()
+
+	wc, err := NewConn(c, &Config{CipherSuites: []uint16{ChaCha20Poly1305}})
+	assert.NoError(t, err)
+
+	err = wc.Negotiate(false)
+	assert.Equal(t, ErrNoCipherSuite, err)
+
+	wg.Wait()
+}
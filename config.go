@@ -0,0 +1,264 @@
+package seconn
+
+import (
+	"crypto"
+	"crypto/rand"
+	"io"
+	"time"
+)
+
+// Config holds the settings used by a Conn. A Config may be shared by
+// many connections and must not be modified once it has been passed
+// to NewConn, NewClient or NewServer. A nil *Config, or any zero valued
+// field, falls back to the package level defaults.
+type Config struct {
+	// The size of the internal encrypted write buffer. Writes larger
+	// than this are split into multiple records. Defaults to WriteBufferSize.
+	WriteBufferSize int
+
+	// The largest record payload we accept from the peer. It's sent to
+	// the peer during the handshake so that it splits its writes to fit.
+	// Values below MinRecordSize are raised to it. Defaults to
+	// MaxRecordSize.
+	MaxRecordSize int
+
+	// The largest message GetMessage accepts. It's also sent to the peer
+	// so that SendMessage can refuse to send larger ones. Defaults to
+	// MaxMessageSize.
+	MaxMessageSize int
+
+	// How many bytes to write over the connection before we rekey.
+	// Defaults to RekeyAfterBytes.
+	RekeyAfterBytes int
+
+	// How long a key may be used before we rekey. A timer rekeys
+	// once it has passed even if nothing is written. Defaults to
+	// KeyValidityPeriod.
+	KeyValidityPeriod time.Duration
+
+	// How many bytes to send with one key before replacing it with a
+	// key update. This is much cheaper than a rekey, so it can be set
+	// far lower than RekeyAfterBytes. Zero, the default, only sends
+	// key updates when Conn.UpdateKey is called.
+	KeyUpdateAfterBytes int
+
+	// If not nil, called every time the keys change, with the new key
+	// epoch and the reason. Calls are made one at a time while the
+	// connection is locked for writing, so it must return quickly and
+	// must not call Write or anything else that writes. KeyEpoch and
+	// KeyUsage are safe to call.
+	OnRekey func(epoch uint64, reason RekeyReason)
+
+	// The lowest and highest protocol versions to use. Zero means
+	// the lowest or highest version this package supports.
+	MinVersion uint16
+	MaxVersion uint16
+
+	// The cipher suites to offer, in order of preference. The server's
+	// preference wins. Defaults to DefaultCipherSuites.
+	CipherSuites []uint16
+
+	// Our long-term identity key, either an ed25519.PrivateKey or a
+	// *KeyPair holding an X25519 key. It is sent to the peer, encrypted,
+	// along with proof that we hold it. With Noise, a *KeyPair is used as
+	// the static key if NoiseConfig.StaticKey isn't set.
+	Identity crypto.PrivateKey
+
+	// If not nil, called during the handshake with the peer's identity
+	// key, see Conn.PeerIdentity. Returning an error aborts Negotiate
+	// before any application data is exchanged. A peer without an
+	// identity is rejected with ErrNoPeerIdentity.
+	VerifyPeerIdentity func(key crypto.PublicKey) error
+
+	// If not nil, use a Noise Protocol Framework handshake instead of
+	// the default one. The hellos are still exchanged first to agree on
+	// a version and cipher suite, and are bound to the noise handshake
+	// as its prologue.
+	Noise *NoiseConfig
+
+	// The source of randomness for keys and IVs. Defaults to crypto/rand.
+	Rand io.Reader
+
+	// The maximum amount of time Negotiate may take. It's set as a
+	// deadline on the underlying connection and cleared once the
+	// handshake is done. Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// How often to ping the peer once the handshake is done. Zero, the
+	// default, disables keepalives. Pongs are processed by Read, so the
+	// connection must be read from for keepalives to work.
+	KeepaliveInterval time.Duration
+
+	// How long to wait for a pong before giving up on the peer, closing
+	// the connection and failing Read and Write with ErrPeerTimeout.
+	// Defaults to KeepaliveInterval.
+	KeepaliveTimeout time.Duration
+
+	// If not nil, called once the handshake has completed but before
+	// Negotiate returns. Returning an error aborts Negotiate and sends
+	// the peer AlertAuthFailed. This is the place to run an exchange from
+	// the auth package, and a Listener runs it before Accept returns a
+	// connection.
+	VerifyConnection func(c *Conn) error
+}
+
+func (c *Config) writeBufferSize() int {
+	if c == nil || c.WriteBufferSize <= 0 {
+		return WriteBufferSize
+	}
+
+	return c.WriteBufferSize
+}
+
+func (c *Config) maxRecordSize() int {
+	size := MaxRecordSize
+
+	if c != nil && c.MaxRecordSize > 0 {
+		size = c.MaxRecordSize
+	}
+
+	if size < MinRecordSize {
+		return MinRecordSize
+	}
+
+	if size > maxRecordField {
+		return maxRecordField
+	}
+
+	return size
+}
+
+func (c *Config) maxMessageSize() int {
+	if c == nil || c.MaxMessageSize <= 0 {
+		return MaxMessageSize
+	}
+
+	return c.MaxMessageSize
+}
+
+func (c *Config) rekeyAfterBytes() int {
+	if c == nil || c.RekeyAfterBytes <= 0 {
+		return RekeyAfterBytes
+	}
+
+	return c.RekeyAfterBytes
+}
+
+func (c *Config) keyValidityPeriod() time.Duration {
+	if c == nil || c.KeyValidityPeriod <= 0 {
+		return KeyValidityPeriod
+	}
+
+	return c.KeyValidityPeriod
+}
+
+func (c *Config) keyUpdateAfterBytes() int {
+	if c == nil {
+		return 0
+	}
+
+	return c.KeyUpdateAfterBytes
+}
+
+func (c *Config) onRekey() func(uint64, RekeyReason) {
+	if c == nil {
+		return nil
+	}
+
+	return c.OnRekey
+}
+
+// The protocol versions allowed by this config, highest first
+func (c *Config) versions() []uint16 {
+	var versions []uint16
+
+	for _, v := range supportedVersions {
+		if c != nil && c.MinVersion != 0 && v < c.MinVersion {
+			continue
+		}
+
+		if c != nil && c.MaxVersion != 0 && v > c.MaxVersion {
+			continue
+		}
+
+		versions = append(versions, v)
+	}
+
+	return versions
+}
+
+func (c *Config) cipherSuites() []uint16 {
+	if c == nil || len(c.CipherSuites) == 0 {
+		return DefaultCipherSuites
+	}
+
+	return c.CipherSuites
+}
+
+func (c *Config) identity() crypto.PrivateKey {
+	if c == nil {
+		return nil
+	}
+
+	return c.Identity
+}
+
+func (c *Config) verifyPeerIdentity() func(crypto.PublicKey) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.VerifyPeerIdentity
+}
+
+func (c *Config) noise() *NoiseConfig {
+	if c == nil {
+		return nil
+	}
+
+	return c.Noise
+}
+
+func (c *Config) rand() io.Reader {
+	if c == nil || c.Rand == nil {
+		return rand.Reader
+	}
+
+	return c.Rand
+}
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c == nil {
+		return 0
+	}
+
+	return c.HandshakeTimeout
+}
+
+func (c *Config) keepaliveInterval() time.Duration {
+	if c == nil {
+		return 0
+	}
+
+	return c.KeepaliveInterval
+}
+
+func (c *Config) keepaliveTimeout() time.Duration {
+	if c == nil {
+		return 0
+	}
+
+	if c.KeepaliveTimeout <= 0 {
+		return c.KeepaliveInterval
+	}
+
+	return c.KeepaliveTimeout
+}
+
+func (c *Config) verifyConnection() func(*Conn) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.VerifyConnection
+}
@@ -0,0 +1,151 @@
+package seconn
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	var cfg *Config
+
+	assert.Equal(t, WriteBufferSize, cfg.writeBufferSize())
+	assert.Equal(t, RekeyAfterBytes, cfg.rekeyAfterBytes())
+	assert.Equal(t, KeyValidityPeriod, cfg.keyValidityPeriod())
+	assert.Equal(t, time.Duration(0), cfg.handshakeTimeout())
+	assert.NotNil(t, cfg.rand())
+
+	cfg = &Config{WriteBufferSize: 16, RekeyAfterBytes: 32}
+
+	assert.Equal(t, 16, cfg.writeBufferSize())
+	assert.Equal(t, 32, cfg.rekeyAfterBytes())
+	assert.Equal(t, KeyValidityPeriod, cfg.keyValidityPeriod())
+}
+
+func TestConfigSharedAcrossConns(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	cfg := &Config{
+		WriteBufferSize: 16,
+		RekeyAfterBytes: 8,
+	}
+
+	data := []byte("this is longer than sixteen bytes")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			o, err := l.Accept()
+			defer o.Close()
+
+			wo, err := NewServer(o, cfg)
+			assert.NoError(t, err)
+			assert.Equal(t, 16, len(wo.writeBuf))
+
+			firstKey := make([]byte, 32)
+			copy(firstKey, (*wo.shared)[:])
+
+			n, err := wo.Write(data)
+			assert.NoError(t, err)
+			assert.Equal(t, len(data), n)
+
+			// The first write exhausted RekeyAfterBytes, so this one rekeys
+			n, err = wo.Write(data)
+			assert.NoError(t, err)
+			assert.Equal(t, len(data), n)
+
+			buf := make([]byte, 2)
+
+			n, err = wo.Read(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("ok"), buf[:n])
+
+			assert.NotEqual(t, firstKey, (*wo.shared)[:])
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		defer c.Close()
+
+		wc, err := NewClient(c, cfg)
+		assert.NoError(t, err)
+
+		buf := make([]byte, len(data))
+
+		for j := 0; j < 2; j++ {
+			total := 0
+			for total < len(data) {
+				n, err := wc.Read(buf[total:])
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				total += n
+			}
+
+			assert.Equal(t, data, buf)
+		}
+
+		_, err = wc.Write([]byte("ok"))
+		assert.NoError(t, err)
+	}
+
+	wg.Wait()
+}
+
+func TestConfigVerifyConnection(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	defer l.Close()
+
+	errReject := errors.New("rejected")
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		o, err := l.Accept()
+		defer o.Close()
+
+		wo, err := NewConn(o, &Config{
+			VerifyConnection: func(c *Conn) error {
+				return errReject
+			},
+		})
+		assert.NoError(t, err)
+
+		err = wo.Negotiate(true)
+		assert.Equal(t, errReject, err)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	defer c.Close()
+
+	var called *Conn
+
+	wc, err := NewConn(c, &Config{
+		VerifyConnection: func(c *Conn) error {
+			called = c
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+
+	err = wc.Negotiate(false)
+	assert.NoError(t, err)
+	assert.Equal(t, wc, called)
+
+	wg.Wait()
+}
@@ -0,0 +1,66 @@
+package seconn
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/vektra/errors"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var ErrExportUnavailable = errors.New("keying material can't be exported before the handshake")
+
+var ErrExportLength = errors.New("too much keying material requested")
+
+// The most keying material HKDF-SHA256 can produce in one go
+const maxExportLength = 255 * sha256.Size
+
+// Derive keying material bound to this connection, in the style of
+// RFC 5705. Both sides get the same bytes for the same label and
+// context, and different labels or contexts give unrelated bytes. It's
+// derived from the handshake alone, so rekeys and key updates don't
+// change it. Use it for channel bindings or to derive keys for other
+// protocols without exposing the connection's own keys.
+func (c *Conn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if c.exporterSecret == nil {
+		return nil, ErrExportUnavailable
+	}
+
+	if length < 0 || length > maxExportLength {
+		return nil, ErrExportLength
+	}
+
+	// The label and context are length prefixed so that moving bytes
+	// from one to the other changes the output.
+	var size [4]byte
+
+	info := []byte("seconn exporter ")
+
+	binary.BigEndian.PutUint32(size[:], uint32(len(label)))
+	info = append(info, size[:]...)
+	info = append(info, label...)
+
+	binary.BigEndian.PutUint32(size[:], uint32(len(context)))
+	info = append(info, size[:]...)
+	info = append(info, context...)
+
+	out := make([]byte, length)
+
+	_, err := io.ReadFull(hkdf.New(sha256.New, c.exporterSecret, nil, info), out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// The secret the exported keying material is derived from. It comes
+// from its own HKDF label, so the traffic keys can't be recovered from
+// it.
+func deriveExporterSecret(secret, salt, handshakeHash []byte) []byte {
+	info := append([]byte("seconn exporter secret "), handshakeHash...)
+
+	return makeKeys(secret, salt, info, sha256.Size)[0]
+}
@@ -0,0 +1,140 @@
+package seconn
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportKeyingMaterial(t *testing.T) {
+	configs := map[string]*Config{
+		"default": nil,
+		"noise":   {Noise: &NoiseConfig{Pattern: NoiseNN}},
+	}
+
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+			require.NoError(t, serr)
+			require.NoError(t, cerr)
+
+			defer wo.Close()
+			defer wc.Close()
+
+			ckm, err := wc.ExportKeyingMaterial("test", []byte("context"), 48)
+			require.NoError(t, err)
+			assert.Len(t, ckm, 48)
+
+			skm, err := wo.ExportKeyingMaterial("test", []byte("context"), 48)
+			require.NoError(t, err)
+			assert.Equal(t, ckm, skm)
+
+			other, err := wc.ExportKeyingMaterial("other", []byte("context"), 48)
+			require.NoError(t, err)
+			assert.NotEqual(t, ckm, other)
+
+			other, err = wc.ExportKeyingMaterial("test", nil, 48)
+			require.NoError(t, err)
+			assert.NotEqual(t, ckm, other)
+
+			// Moving bytes between the label and context matters
+			other, err = wc.ExportKeyingMaterial("testc", []byte("ontext"), 48)
+			require.NoError(t, err)
+			assert.NotEqual(t, ckm, other)
+
+			// A shorter export is a prefix of a longer one
+			short, err := wc.ExportKeyingMaterial("test", []byte("context"), 16)
+			require.NoError(t, err)
+			assert.Equal(t, ckm[:16], short)
+		})
+	}
+}
+
+func TestExportKeyingMaterialIsPerConnection(t *testing.T) {
+	wo1, wc1, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo1.Close()
+	defer wc1.Close()
+
+	wo2, wc2, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo2.Close()
+	defer wc2.Close()
+
+	km1, err := wc1.ExportKeyingMaterial("test", nil, 32)
+	require.NoError(t, err)
+
+	km2, err := wc2.ExportKeyingMaterial("test", nil, 32)
+	require.NoError(t, err)
+
+	assert.NotEqual(t, km1, km2)
+}
+
+func TestExportKeyingMaterialStableAcrossRekeys(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	before, err := wc.ExportKeyingMaterial("test", nil, 32)
+	require.NoError(t, err)
+
+	go io.Copy(wo, wo)
+
+	wc.RekeyNext()
+	require.NoError(t, wc.UpdateKey())
+
+	buf := make([]byte, 5)
+
+	for i := 0; i < 2; i++ {
+		_, err = wc.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		_, err = io.ReadFull(wc, buf)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, uint64(2), wc.KeyEpoch())
+
+	after, err := wc.ExportKeyingMaterial("test", nil, 32)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestExportKeyingMaterialErrors(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	c, err := NewConn(a, nil)
+	require.NoError(t, err)
+
+	_, err = c.ExportKeyingMaterial("test", nil, 32)
+	assert.Equal(t, ErrExportUnavailable, err)
+
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	_, err = wc.ExportKeyingMaterial("test", nil, maxExportLength+1)
+	assert.Equal(t, ErrExportLength, err)
+
+	_, err = wc.ExportKeyingMaterial("test", nil, -1)
+	assert.Equal(t, ErrExportLength, err)
+
+	km, err := wc.ExportKeyingMaterial("test", nil, maxExportLength)
+	require.NoError(t, err)
+	assert.Len(t, km, maxExportLength)
+}
@@ -0,0 +1,126 @@
+package seconn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Shut down the writing side of the connection. The peer's Read returns
+// io.EOF once it has read everything we sent, while data still flows
+// from the peer to us. If the underlying connection has a CloseWrite
+// method, such as *net.TCPConn, it's called as well. Write returns
+// ErrWriteClosed afterwards.
+func (c *Conn) CloseWrite() error {
+	err := c.sendCloseNotify()
+	if err != nil {
+		return err
+	}
+
+	// We can't send pings any more
+	c.stopKeepalive()
+
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+// Shut down the reading side of the underlying connection, if it has a
+// CloseRead method. Otherwise this does nothing.
+func (c *Conn) CloseRead() error {
+	if cr, ok := c.Conn.(interface {
+		CloseRead() error
+	}); ok {
+		return cr.CloseRead()
+	}
+
+	return nil
+}
+
+// The key for one direction after a one-way rekey
+func oneWayKey(shared *[32]byte, iv []byte, size int) []byte {
+	return makeKeys((*shared)[:], iv, []byte("seconn one-way rekey"), size)[0]
+}
+
+// Replace the key for our direction without the peer's help, used once
+// the peer has half closed and can't answer a normal rekey. We send a
+// fresh ephemeral key and switch to a key derived from it and the peer's
+// current public key, so the peer can follow using its private key.
+// The caller must hold writeLock.
+func (c *Conn) oneWayRekey(reason RekeyReason) error {
+	c.resetRekeyLimits()
+
+	pub, priv, err := GenerateKey(c.config.rand())
+	if err != nil {
+		return err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+
+	_, err = io.ReadFull(c.config.rand(), iv)
+	if err != nil {
+		return err
+	}
+
+	var shared [32]byte
+
+	curve25519.ScalarMult(&shared, priv, c.peerKey)
+
+	var buf bytes.Buffer
+	buf.Write((*pub)[:])
+	buf.Write(iv)
+
+	err = c.writeRecord(pOneWayRekey, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	err = c.write.setup(c.suite, oneWayKey(&shared, iv, c.suite.KeySize), iv)
+	if err != nil {
+		return err
+	}
+
+	c.keyChanged(reason)
+
+	return nil
+}
+
+func (c *Conn) readOneWayRekey(cnt uint32) error {
+	buf, err := c.readAndCheck(cnt)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) != cKeySize+aes.BlockSize {
+		return ErrBadRekey
+	}
+
+	var pub, shared [32]byte
+
+	copy(pub[:], buf[:cKeySize])
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	err = sharedSecret(&shared, c.privKey, &pub)
+	if err != nil {
+		return err
+	}
+
+	iv := buf[cKeySize:]
+
+	err = c.read.setup(c.suite, oneWayKey(&shared, iv, c.suite.KeySize), iv)
+	if err != nil {
+		return err
+	}
+
+	c.keyChanged(RekeyPeer)
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package seconn
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseWrite(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wc.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer wo.Close()
+
+		data, err := ioutil.ReadAll(wo)
+		assert.NoError(t, err)
+		assert.Equal(t, "request", string(data))
+
+		_, err = wo.Write([]byte("response"))
+		assert.NoError(t, err)
+	}()
+
+	_, err := wc.Write([]byte("request"))
+	require.NoError(t, err)
+
+	require.NoError(t, wc.CloseWrite())
+
+	_, err = wc.Write([]byte("more"))
+	assert.Equal(t, ErrWriteClosed, err)
+
+	data, err := ioutil.ReadAll(wc)
+	assert.NoError(t, err)
+	assert.Equal(t, "response", string(data))
+
+	wg.Wait()
+}
+
+// Write msgs, rekeying before each, and then close
+func writeRekeyed(t *testing.T, c *Conn, msgs []string) {
+	defer c.Close()
+
+	for _, msg := range msgs {
+		c.RekeyNext()
+
+		_, err := c.Write([]byte(msg))
+		assert.NoError(t, err)
+	}
+}
+
+func TestCloseWriteRekeysOneWay(t *testing.T) {
+	msgs := []string{"one", "two", "three"}
+
+	for _, clientCloses := range []bool{true, false} {
+		wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+		require.NoError(t, serr)
+		require.NoError(t, cerr)
+
+		closer, writer := wc, wo
+		if !clientCloses {
+			closer, writer = wo, wc
+		}
+
+		require.NoError(t, closer.CloseWrite())
+
+		// Wait for the close before writing so that only one-way
+		// rekeys are used.
+		_, err := writer.Read(make([]byte, 1))
+		require.Error(t, err)
+
+		firstKey := closer.read.aead
+
+		go writeRekeyed(t, writer, msgs)
+
+		data, err := ioutil.ReadAll(closer)
+		assert.NoError(t, err)
+		assert.Equal(t, "onetwothree", string(data))
+
+		assert.True(t, firstKey != closer.read.aead)
+
+		closer.Close()
+	}
+}
+
+func TestCloseWriteDuringRekey(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wc.Close()
+
+	// The server starts a rekey that the client closes before seeing
+	wo.RekeyNext()
+
+	_, err := wo.Write([]byte("before"))
+	require.NoError(t, err)
+
+	require.NoError(t, wc.CloseWrite())
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		data, err := ioutil.ReadAll(wo)
+		assert.NoError(t, err)
+		assert.Empty(t, data)
+
+		writeRekeyed(t, wo, []string{" after"})
+	}()
+
+	data, err := ioutil.ReadAll(wc)
+	assert.NoError(t, err)
+	assert.Equal(t, "before after", string(data))
+
+	wg.Wait()
+}
@@ -0,0 +1,755 @@
+package seconn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	stderrors "errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/vektra/errors"
+)
+
+// Protocol versions understood by this package
+const (
+	Version1 uint16 = 0x0001
+
+	// Authenticates the record header as associated data of the
+	// payload instead of sealing it separately.
+	Version2 uint16 = 0x0002
+)
+
+// Every handshake message starts with these bytes, so that a peer
+// speaking something else is detected right away.
+const handshakeMagic = "SECN"
+
+// The versions we implement, highest first
+var supportedVersions = []uint16{Version2, Version1}
+
+var ErrBadMagic = errors.New("peer is not speaking the seconn protocol")
+
+var ErrUnsupportedVersion = errors.New("no protocol version in common with peer")
+
+var ErrHandshakeFailed = errors.New("handshake transcript verification failed")
+
+var ErrPeerClosed = errors.New("peer closed the connection during the handshake")
+
+var ErrBadLength = errors.New("handshake message has a bad length")
+
+var ErrMalformedKey = errors.New("peer sent a malformed key")
+
+var ErrHandshakeTimeout = errors.New("handshake timed out")
+
+// Handshake message types
+const (
+	msgClientHello uint8 = 1
+	msgServerHello uint8 = 2
+	msgFinished    uint8 = 3
+	msgNoise       uint8 = 4
+	msgIdentity    uint8 = 5
+	msgAlert       uint8 = 6
+)
+
+// Hello extension types
+const (
+	extCipherSuites uint16 = 1
+	extKeyShare     uint16 = 2
+	extNoisePattern uint16 = 3
+	extLimits       uint16 = 4
+)
+
+const helloRandomSize = 32
+
+// The hello message sent by both sides. The client lists every version
+// it supports; the server replies with the single version it picked,
+// or none if there wasn't one in common.
+type hello struct {
+	versions   []uint16
+	random     []byte
+	extensions []extension
+}
+
+type extension struct {
+	typ  uint16
+	data []byte
+}
+
+func (h *hello) marshal() []byte {
+	var buf bytes.Buffer
+
+	buf.WriteByte(uint8(len(h.versions)))
+	binary.Write(&buf, binary.BigEndian, h.versions)
+
+	buf.Write(h.random)
+
+	for _, ext := range h.extensions {
+		binary.Write(&buf, binary.BigEndian, ext.typ)
+		binary.Write(&buf, binary.BigEndian, uint16(len(ext.data)))
+		buf.Write(ext.data)
+	}
+
+	return buf.Bytes()
+}
+
+func (h *hello) unmarshal(data []byte) error {
+	if len(data) < 1 {
+		return ErrBadLength
+	}
+
+	cnt := int(data[0])
+	data = data[1:]
+
+	if len(data) < cnt*2+helloRandomSize {
+		return ErrBadLength
+	}
+
+	h.versions = make([]uint16, cnt)
+
+	for i := range h.versions {
+		h.versions[i] = binary.BigEndian.Uint16(data)
+		data = data[2:]
+	}
+
+	h.random = data[:helloRandomSize]
+	data = data[helloRandomSize:]
+
+	h.extensions = nil
+
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return ErrBadLength
+		}
+
+		typ := binary.BigEndian.Uint16(data)
+		size := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+
+		if len(data) < size {
+			return ErrBadLength
+		}
+
+		if h.extension(typ) != nil {
+			return ErrProtocolError
+		}
+
+		h.extensions = append(h.extensions, extension{typ, data[:size]})
+		data = data[size:]
+	}
+
+	return nil
+}
+
+func (h *hello) addExtension(typ uint16, data []byte) {
+	h.extensions = append(h.extensions, extension{typ, data})
+}
+
+// Return the data for an extension, or nil if it wasn't sent.
+// Unknown extensions are ignored so newer peers can add them freely.
+func (h *hello) extension(typ uint16) []byte {
+	for _, ext := range h.extensions {
+		if ext.typ == typ {
+			return ext.data
+		}
+	}
+
+	return nil
+}
+
+func marshalUint16s(vals []uint16) []byte {
+	buf := make([]byte, len(vals)*2)
+
+	for i, v := range vals {
+		binary.BigEndian.PutUint16(buf[i*2:], v)
+	}
+
+	return buf
+}
+
+func unmarshalUint16s(data []byte) ([]uint16, error) {
+	if len(data)%2 != 0 {
+		return nil, ErrBadLength
+	}
+
+	vals := make([]uint16, len(data)/2)
+
+	for i := range vals {
+		vals[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+
+	return vals, nil
+}
+
+// Turn the errors a broken or hung up connection gives during the
+// handshake into the ones we document, passing anything else through.
+func handshakeError(err error) error {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return ErrPeerClosed
+	}
+
+	// A peer that hangs up with our data still unread resets the
+	// connection instead.
+	if stderrors.Is(err, syscall.ECONNRESET) {
+		return ErrPeerClosed
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrHandshakeTimeout
+	}
+
+	return err
+}
+
+// Pick the highest version in ours that also appears in theirs.
+func pickVersion(ours, theirs []uint16) (uint16, bool) {
+	var best uint16
+	var found bool
+
+	for _, v := range ours {
+		for _, t := range theirs {
+			if v == t && (!found || v > best) {
+				best = v
+				found = true
+			}
+		}
+	}
+
+	return best, found
+}
+
+// Write a handshake message, adding it to the transcript
+func (c *Conn) writeHandshake(typ uint8, body []byte) error {
+	msg := make([]byte, len(handshakeMagic)+3+len(body))
+
+	copy(msg, handshakeMagic)
+	msg[4] = typ
+	binary.BigEndian.PutUint16(msg[5:], uint16(len(body)))
+	copy(msg[7:], body)
+
+	c.transcript.Write(msg)
+
+	n, err := c.Conn.Write(msg)
+	if err != nil {
+		return err
+	}
+
+	if n != len(msg) {
+		return io.ErrShortWrite
+	}
+
+	return nil
+}
+
+// Read a handshake message of the given type, adding it to the transcript
+func (c *Conn) readHandshake(typ uint8) ([]byte, error) {
+	header := make([]byte, len(handshakeMagic)+3)
+
+	_, err := io.ReadFull(c.Conn, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(header[:4]) != handshakeMagic {
+		return nil, ErrBadMagic
+	}
+
+	if header[4] != typ && header[4] != msgAlert {
+		return nil, ErrProtocolError
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[5:]))
+
+	_, err = io.ReadFull(c.Conn, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if header[4] == msgAlert {
+		c.alerted = true
+
+		alert, err := unmarshalAlert(body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, alert
+	}
+
+	c.transcript.Write(header)
+	c.transcript.Write(body)
+
+	return body, nil
+}
+
+// The MAC sent in a Finished message. It covers every handshake
+// message seen so far, so any tampering with the hellos, such as
+// stripping newer versions, causes verification to fail.
+func (c *Conn) finishedMAC(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(c.transcript.Sum(nil))
+	return mac.Sum(nil)
+}
+
+func (c *Conn) sendFinished(key []byte) error {
+	return c.writeHandshake(msgFinished, c.finishedMAC(key))
+}
+
+func (c *Conn) readFinished(key []byte) error {
+	expected := c.finishedMAC(key)
+
+	msg, err := c.readHandshake(msgFinished)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, msg) {
+		return ErrHandshakeFailed
+	}
+
+	return nil
+}
+
+func (c *Conn) newHello(versions []uint16) (*hello, error) {
+	h := &hello{
+		versions: versions,
+		random:   make([]byte, helloRandomSize),
+	}
+
+	_, err := io.ReadFull(c.config.rand(), h.random)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (c *Conn) negotiate(server bool) error {
+	c.server = server
+	c.transcript = sha256.New()
+
+	pub, priv, err := GenerateKey(c.config.rand())
+	if err != nil {
+		return err
+	}
+
+	c.pubKey = pub
+	c.privKey = priv
+
+	if server {
+		err = c.serverHandshake()
+	} else {
+		err = c.clientHandshake()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.deriveAuthTokens()
+
+	return nil
+}
+
+// Derive the auth tokens once the transcript covers every handshake
+// message, including the finished messages.
+func (c *Conn) deriveAuthTokens() {
+	hash := c.transcript.Sum(nil)
+
+	c.clientToken = authToken(c.exporterSecret, "client", hash)
+	c.serverToken = authToken(c.exporterSecret, "server", hash)
+}
+
+func authToken(secret []byte, role string, transcriptHash []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("seconn auth token " + role))
+	mac.Write(transcriptHash)
+	return mac.Sum(nil)
+}
+
+// The cipher suites we can offer. Noise only defines names for some
+// of them, so the others are left out when using it.
+func (c *Conn) offeredCipherSuites() []uint16 {
+	prefs := c.config.cipherSuites()
+
+	if c.config.noise() == nil {
+		return prefs
+	}
+
+	var suites []uint16
+
+	for _, id := range prefs {
+		if _, ok := noiseCipherNames[id]; ok {
+			suites = append(suites, id)
+		}
+	}
+
+	return suites
+}
+
+func (c *Conn) clientHandshake() error {
+	noise := c.config.noise()
+
+	ch, err := c.newHello(c.config.versions())
+	if err != nil {
+		return err
+	}
+
+	ch.addExtension(extCipherSuites, marshalUint16s(c.offeredCipherSuites()))
+	ch.addExtension(extLimits, c.marshalLimits())
+
+	if noise != nil {
+		ch.addExtension(extNoisePattern, []byte{byte(noise.Pattern)})
+	} else {
+		ch.addExtension(extKeyShare, (*c.pubKey)[:])
+	}
+
+	err = c.writeHandshake(msgClientHello, ch.marshal())
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.readHandshake(msgServerHello)
+	if err != nil {
+		return err
+	}
+
+	var sh hello
+
+	err = sh.unmarshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if len(sh.versions) != 1 {
+		return ErrUnsupportedVersion
+	}
+
+	version, ok := pickVersion(c.config.versions(), sh.versions)
+	if !ok {
+		return ErrUnsupportedVersion
+	}
+
+	if !matchNoisePattern(noise, sh.extension(extNoisePattern)) {
+		return ErrNoisePattern
+	}
+
+	suites, err := unmarshalUint16s(sh.extension(extCipherSuites))
+	if err != nil {
+		return err
+	}
+
+	if len(suites) != 1 {
+		return ErrNoCipherSuite
+	}
+
+	suite, err := selectCipherSuite(c.offeredCipherSuites(), suites)
+	if err != nil {
+		return err
+	}
+
+	err = c.unmarshalLimits(sh.extension(extLimits))
+	if err != nil {
+		return err
+	}
+
+	c.version = version
+	c.suite = suite
+
+	if noise != nil {
+		return c.noiseHandshake(noise)
+	}
+
+	peerKey := sh.extension(extKeyShare)
+	if len(peerKey) != cKeySize {
+		return ErrMalformedKey
+	}
+
+	err = c.exchangeKeys(peerKey)
+	if err != nil {
+		return err
+	}
+
+	keys := c.establishKeys(ch.random, sh.random)
+	idKeys := c.identityKeys()
+
+	err = c.readIdentity(idKeys[0])
+	if err != nil {
+		return err
+	}
+
+	err = c.readFinished(keys[0])
+	if err != nil {
+		return err
+	}
+
+	err = c.sendIdentity(idKeys[1])
+	if err != nil {
+		return err
+	}
+
+	err = c.sendFinished(keys[1])
+	if err != nil {
+		return err
+	}
+
+	return c.setupHalves(c.trafficKeys())
+}
+
+func (c *Conn) serverHandshake() error {
+	msg, err := c.readHandshake(msgClientHello)
+	if err != nil {
+		return err
+	}
+
+	var ch hello
+
+	err = ch.unmarshal(msg)
+	if err != nil {
+		return err
+	}
+
+	version, ok := pickVersion(c.config.versions(), ch.versions)
+	if !ok {
+		return c.rejectHello(nil, nil, ErrUnsupportedVersion)
+	}
+
+	noise := c.config.noise()
+	noiseExt := ch.extension(extNoisePattern)
+
+	if !matchNoisePattern(noise, noiseExt) {
+		var ours []byte
+		if noise != nil {
+			ours = []byte{byte(noise.Pattern)}
+		}
+
+		// Send back our own pattern so the client can tell why
+		return c.rejectHello([]uint16{version}, ours, ErrNoisePattern)
+	}
+
+	offered, err := unmarshalUint16s(ch.extension(extCipherSuites))
+	if err != nil {
+		return err
+	}
+
+	suite, err := selectCipherSuite(c.offeredCipherSuites(), offered)
+	if err != nil {
+		return c.rejectHello([]uint16{version}, noiseExt, err)
+	}
+
+	// A hello can't say what's wrong with these, so the client gets an
+	// alert instead.
+	if noise == nil {
+		peerKey := ch.extension(extKeyShare)
+		if len(peerKey) != cKeySize {
+			return ErrMalformedKey
+		}
+
+		err = c.exchangeKeys(peerKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.unmarshalLimits(ch.extension(extLimits))
+	if err != nil {
+		return err
+	}
+
+	c.version = version
+	c.suite = suite
+
+	sh, err := c.newHello([]uint16{version})
+	if err != nil {
+		return err
+	}
+
+	sh.addExtension(extCipherSuites, marshalUint16s([]uint16{suite.ID}))
+	sh.addExtension(extLimits, c.marshalLimits())
+
+	if noise != nil {
+		sh.addExtension(extNoisePattern, noiseExt)
+	} else {
+		sh.addExtension(extKeyShare, (*c.pubKey)[:])
+	}
+
+	err = c.writeHandshake(msgServerHello, sh.marshal())
+	if err != nil {
+		return err
+	}
+
+	if noise != nil {
+		return c.noiseHandshake(noise)
+	}
+
+	keys := c.establishKeys(ch.random, sh.random)
+	idKeys := c.identityKeys()
+
+	// Ready early so that if the client's half fails, we can send it
+	// an alert. It will be expecting records by then.
+	err = c.setupHalves(c.trafficKeys())
+	if err != nil {
+		return err
+	}
+
+	err = c.sendIdentity(idKeys[0])
+	if err != nil {
+		return err
+	}
+
+	err = c.sendFinished(keys[0])
+	if err != nil {
+		return err
+	}
+
+	c.peerDone = true
+
+	err = c.readIdentity(idKeys[1])
+	if err != nil {
+		return err
+	}
+
+	return c.readFinished(keys[1])
+}
+
+// Our record and message size limits, as advertised in our hello
+func (c *Conn) marshalLimits() []byte {
+	buf := make([]byte, 8)
+
+	binary.BigEndian.PutUint32(buf, uint32(c.config.maxRecordSize()))
+	binary.BigEndian.PutUint32(buf[4:], uint32(c.config.maxMessageSize()))
+
+	return buf
+}
+
+// Remember the limits the peer advertised. Peers that don't send them
+// are left unlimited, our own limits still apply to what they send.
+func (c *Conn) unmarshalLimits(data []byte) error {
+	if data == nil {
+		return nil
+	}
+
+	if len(data) != 8 {
+		return ErrBadLength
+	}
+
+	maxRecord := binary.BigEndian.Uint32(data)
+	maxMessage := binary.BigEndian.Uint32(data[4:])
+
+	if maxRecord < MinRecordSize || maxMessage == 0 {
+		return ErrProtocolError
+	}
+
+	c.peerMaxRecord = int(maxRecord)
+	c.peerMaxMessage = int(maxMessage)
+
+	return nil
+}
+
+// Check that the noise pattern the peer sent matches ours. Both sides
+// must either not be using noise or be using the same pattern.
+func matchNoisePattern(noise *NoiseConfig, ext []byte) bool {
+	if noise == nil {
+		return ext == nil
+	}
+
+	return len(ext) == 1 && NoisePattern(ext[0]) == noise.Pattern
+}
+
+// Tell the client we can't talk to it by sending back a server hello
+// without the parts we couldn't agree on, then return err.
+func (c *Conn) rejectHello(versions []uint16, noiseExt []byte, err error) error {
+	sh, rerr := c.newHello(versions)
+	if rerr != nil {
+		return rerr
+	}
+
+	if noiseExt != nil {
+		sh.addExtension(extNoisePattern, noiseExt)
+	}
+
+	c.writeHandshake(msgServerHello, sh.marshal())
+
+	// The client can tell what went wrong from the hello
+	c.alerted = true
+
+	return err
+}
+
+// Calculate the shared secret from the peer's key share
+func (c *Conn) exchangeKeys(peerKey []byte) error {
+	c.peerKey = new([32]byte)
+	copy((*c.peerKey)[:], peerKey)
+
+	c.shared = new([32]byte)
+
+	return sharedSecret(c.shared, c.privKey, c.peerKey)
+}
+
+// Derive the traffic keys and the finished keys from the shared secret,
+// returning them server first.
+func (c *Conn) establishKeys(clientRandom, serverRandom []byte) [][]byte {
+	salt := make([]byte, 0, len(clientRandom)+len(serverRandom))
+	salt = append(salt, clientRandom...)
+	salt = append(salt, serverRandom...)
+
+	c.handshakeSalt = salt
+	c.handshakeHash = c.transcript.Sum(nil)
+
+	c.exporterSecret = deriveExporterSecret((*c.shared)[:], salt, c.handshakeHash)
+
+	info := append([]byte("seconn finished "), c.handshakeHash...)
+
+	return makeKeys((*c.shared)[:], salt, info, sha256.Size)
+}
+
+// Derive the traffic keys from the shared secret and the hellos.
+// The server's key is returned first.
+func (c *Conn) trafficKeys() [][]byte {
+	info := append([]byte("seconn traffic "), c.handshakeHash...)
+
+	return makeKeys((*c.shared)[:], c.handshakeSalt, info, c.suite.KeySize)
+}
+
+// Setup the read and write halves and get ready to send records.
+// newKeys holds the server's write key followed by the client's.
+func (c *Conn) setupHalves(newKeys [][]byte) error {
+	c.read = &half{}
+	c.write = &half{}
+
+	var err error
+
+	if c.server {
+		err = c.read.setup(c.suite, newKeys[1], nil)
+		if err == nil {
+			err = c.write.setup(c.suite, newKeys[0], nil)
+		}
+	} else {
+		err = c.read.setup(c.suite, newKeys[0], nil)
+		if err == nil {
+			err = c.write.setup(c.suite, newKeys[1], nil)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if c.headerInClear() {
+		c.headerBuf = make([]byte, recordHeaderSize)
+		c.recordBuf = make([]byte, 0, recordHeaderSize+len(c.writeBuf)+1+c.write.aead.Overhead())
+	} else {
+		c.headerBuf = make([]byte, recordHeaderSize+c.write.aead.Overhead())
+	}
+
+	c.resetRekeyLimits()
+
+	return nil
+}
+
+// Return the protocol version negotiated for this connection
+func (c *Conn) Version() uint16 {
+	return c.version
+}
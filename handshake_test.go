@@ -0,0 +1,599 @@
+package seconn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHelloMarshal(t *testing.T) {
+	h := &hello{
+		versions: []uint16{2, 1},
+		random:   make([]byte, helloRandomSize),
+	}
+
+	h.random[0] = 42
+
+	h.addExtension(extCipherSuites, marshalUint16s([]uint16{AES128GCM}))
+	h.addExtension(0x7777, []byte("from the future"))
+
+	var h2 hello
+
+	err := h2.unmarshal(h.marshal())
+	assert.NoError(t, err)
+
+	assert.Equal(t, h.versions, h2.versions)
+	assert.Equal(t, h.random, h2.random)
+	assert.Equal(t, []byte("from the future"), h2.extension(0x7777))
+	assert.Nil(t, h2.extension(extKeyShare))
+
+	suites, err := unmarshalUint16s(h2.extension(extCipherSuites))
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{AES128GCM}, suites)
+}
+
+func TestHelloUnmarshalRejectsGarbage(t *testing.T) {
+	h := &hello{
+		versions: []uint16{1},
+		random:   make([]byte, helloRandomSize),
+	}
+
+	h.addExtension(extKeyShare, make([]byte, 32))
+	h.addExtension(extKeyShare, make([]byte, 32))
+
+	data := h.marshal()
+
+	var h2 hello
+
+	// duplicate extension
+	assert.Equal(t, ErrProtocolError, h2.unmarshal(data))
+
+	// truncated extension
+	assert.Equal(t, ErrBadLength, h2.unmarshal(data[:len(data)-1]))
+
+	// truncated random
+	assert.Equal(t, ErrBadLength, h2.unmarshal(data[:10]))
+
+	assert.Equal(t, ErrBadLength, h2.unmarshal(nil))
+}
+
+func TestPickVersion(t *testing.T) {
+	v, ok := pickVersion([]uint16{3, 2, 1}, []uint16{1, 2})
+	assert.True(t, ok)
+	assert.Equal(t, uint16(2), v)
+
+	_, ok = pickVersion([]uint16{3}, []uint16{1, 2})
+	assert.False(t, ok)
+}
+
+func TestHandshakeNegotiatesVersion(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		o, err := l.Accept()
+		defer o.Close()
+
+		wo, err := NewServer(o, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, Version2, wo.Version())
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	defer c.Close()
+
+	wc, err := NewClient(c, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Version2, wc.Version())
+
+	wg.Wait()
+}
+
+func TestHandshakeNoCommonVersion(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		o, err := l.Accept()
+		defer o.Close()
+
+		wo, err := NewConn(o, &Config{MinVersion: 0x0100})
+		assert.NoError(t, err)
+
+		err = wo.Negotiate(true)
+		assert.Equal(t, ErrUnsupportedVersion, err)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	defer c.Close()
+
+	wc, err := NewConn(c, nil)
+	assert.NoError(t, err)
+
+	err = wc.Negotiate(false)
+	assert.Equal(t, ErrUnsupportedVersion, err)
+
+	wg.Wait()
+}
+
+func TestHandshakeRejectsOtherProtocols(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		o, err := l.Accept()
+		defer o.Close()
+
+		wo, err := NewConn(o, nil)
+		assert.NoError(t, err)
+
+		err = wo.Negotiate(true)
+		assert.Equal(t, ErrBadMagic, err)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	defer c.Close()
+
+	// The start of the original, unversioned handshake
+	err = binary.Write(c, binary.BigEndian, uint32(32))
+	assert.NoError(t, err)
+
+	_, err = c.Write(make([]byte, 32))
+	assert.NoError(t, err)
+
+	wg.Wait()
+}
+
+// Sit between a client and server, passing the client hello to fn
+// before forwarding it and then copying everything else untouched.
+func tamperingProxy(t *testing.T, server string, fn func(msg []byte)) net.Listener {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		s, err := net.Dial("tcp", server)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer s.Close()
+
+		header := make([]byte, 7)
+
+		_, err = io.ReadFull(c, header)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		msg := make([]byte, len(header)+int(binary.BigEndian.Uint16(header[5:])))
+		copy(msg, header)
+
+		_, err = io.ReadFull(c, msg[len(header):])
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		fn(msg)
+
+		_, err = s.Write(msg)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		go io.Copy(c, s)
+		io.Copy(s, c)
+	}()
+
+	return l
+}
+
+func TestHandshakeDetectsTampering(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	// Change the last byte of the client random, as an attacker
+	// rewriting the version list would have to change the hello.
+	p := tamperingProxy(t, l.Addr().String(), func(msg []byte) {
+		msg[7+1+2*len(supportedVersions)+helloRandomSize-1] ^= 0xff
+	})
+	defer p.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		o, err := l.Accept()
+		defer o.Close()
+
+		wo, err := NewConn(o, nil)
+		assert.NoError(t, err)
+
+		// The client tells us why it gave up
+		err = wo.Negotiate(true)
+		assert.Equal(t, &AlertError{Code: AlertHandshakeFailed}, err)
+	}()
+
+	c, err := net.Dial("tcp", p.Addr().String())
+	assert.NoError(t, err)
+
+	wc, err := NewConn(c, nil)
+	assert.NoError(t, err)
+
+	err = wc.Negotiate(false)
+	assert.Equal(t, ErrHandshakeFailed, err)
+
+	c.Close()
+
+	wg.Wait()
+}
+
+// Accept a connection and run NewServer on it, returning the error once
+// the client side is done with fn.
+func serverError(t *testing.T, config *Config, fn func(c net.Conn)) error {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	errs := make(chan error, 1)
+
+	go func() {
+		o, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		wo, err := NewServer(o, config)
+		assert.Nil(t, wo)
+
+		errs <- err
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	fn(c)
+
+	err = <-errs
+
+	// The server must have closed its side after failing
+	c.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, rerr := io.Copy(io.Discard, c)
+	assert.NoError(t, rerr)
+
+	return err
+}
+
+func writeRawHandshake(t *testing.T, c net.Conn, typ uint8, body []byte) {
+	msg := make([]byte, 7+len(body))
+
+	copy(msg, handshakeMagic)
+	msg[4] = typ
+	binary.BigEndian.PutUint16(msg[5:], uint16(len(body)))
+	copy(msg[7:], body)
+
+	_, err := c.Write(msg)
+	assert.NoError(t, err)
+}
+
+func TestHandshakeTruncatedHello(t *testing.T) {
+	err := serverError(t, nil, func(c net.Conn) {
+		_, err := c.Write([]byte("SEC"))
+		assert.NoError(t, err)
+
+		c.(*net.TCPConn).CloseWrite()
+	})
+
+	assert.Equal(t, ErrPeerClosed, err)
+
+	err = serverError(t, nil, func(c net.Conn) {
+		_, err := c.Write([]byte{'S', 'E', 'C', 'N', msgClientHello, 0, 100, 1, 2, 3})
+		assert.NoError(t, err)
+
+		c.(*net.TCPConn).CloseWrite()
+	})
+
+	assert.Equal(t, ErrPeerClosed, err)
+}
+
+func TestHandshakeGarbageHello(t *testing.T) {
+	err := serverError(t, nil, func(c net.Conn) {
+		writeRawHandshake(t, c, msgClientHello, []byte{200, 1, 2, 3})
+	})
+
+	assert.Equal(t, ErrBadLength, err)
+}
+
+func TestHandshakeMalformedKeyShare(t *testing.T) {
+	pub, _, err := GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	cases := []struct {
+		share, limits []byte
+		err           error
+	}{
+		// The wrong size
+		{make([]byte, 7), nil, ErrMalformedKey},
+
+		// The all zero point is low order and makes the shared secret zero
+		{make([]byte, cKeySize), nil, ErrMalformedKey},
+
+		{(*pub)[:], []byte{1, 2, 3}, ErrBadLength},
+	}
+
+	for _, tc := range cases {
+		h := &hello{
+			versions: supportedVersions,
+			random:   make([]byte, helloRandomSize),
+		}
+
+		h.addExtension(extCipherSuites, marshalUint16s(DefaultCipherSuites))
+		h.addExtension(extKeyShare, tc.share)
+
+		if tc.limits != nil {
+			h.addExtension(extLimits, tc.limits)
+		}
+
+		var clientErr error
+
+		err := serverError(t, nil, func(c net.Conn) {
+			writeRawHandshake(t, c, msgClientHello, h.marshal())
+
+			// What a client waiting for the server hello gets
+			_, clientErr = (&Conn{Conn: c}).readHandshake(msgServerHello)
+		})
+
+		assert.Equal(t, tc.err, err)
+		assert.Equal(t, &AlertError{Code: AlertProtocolError}, clientErr)
+	}
+}
+
+func TestHandshakeErrorWrappedReset(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+	assert.Equal(t, ErrPeerClosed, handshakeError(reset))
+	assert.Equal(t, ErrPeerClosed, handshakeError(fmt.Errorf("reading hello: %w", reset)))
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	config := &Config{HandshakeTimeout: 50 * time.Millisecond}
+
+	err := serverError(t, config, func(c net.Conn) {})
+
+	assert.Equal(t, ErrHandshakeTimeout, err)
+}
+
+func TestNewClientReturnsHandshakeErrors(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		o, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		// Hang up without answering the client hello
+		o.Close()
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	wc, err := NewClient(c, nil)
+	assert.Nil(t, wc)
+	assert.Equal(t, ErrPeerClosed, err)
+}
+
+func TestHandshakeDetectsDowngrade(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	// Strip Version2 from the client's list so both sides would
+	// otherwise settle on Version1.
+	p := tamperingProxy(t, l.Addr().String(), func(msg []byte) {
+		for i := 0; i < int(msg[7]); i++ {
+			binary.BigEndian.PutUint16(msg[8+i*2:], Version1)
+		}
+	})
+	defer p.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		o, err := l.Accept()
+		defer o.Close()
+
+		_, err = NewServer(o, nil)
+		assert.Error(t, err)
+	}()
+
+	c, err := net.Dial("tcp", p.Addr().String())
+	assert.NoError(t, err)
+
+	_, err = NewClient(c, nil)
+	assert.Equal(t, ErrHandshakeFailed, err)
+
+	wg.Wait()
+}
+
+func TestNegotiateContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	o, err := l.Accept()
+	assert.NoError(t, err)
+	defer o.Close()
+
+	wo, err := NewConn(o, nil)
+	assert.NoError(t, err)
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	// The client never says anything, so only cancel gets us out
+	err = wo.NegotiateContext(ctx, true)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestNegotiateContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+
+	o, err := l.Accept()
+	assert.NoError(t, err)
+	defer o.Close()
+
+	wo, err := NewConn(o, &Config{HandshakeTimeout: time.Hour})
+	assert.NoError(t, err)
+
+	err = wo.NegotiateContext(ctx, true)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestNegotiateContextCancelDuringVerify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Cancel once the handshake itself is done and give the watcher
+	// time to notice.
+	ccfg := &Config{
+		VerifyConnection: func(c *Conn) error {
+			cancel()
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		},
+	}
+
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		o, err := l.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer o.Close()
+
+		wo, err := NewServer(o, nil)
+		if err != nil {
+			return
+		}
+
+		wo.Read(make([]byte, 1))
+	}()
+
+	_, err = DialContext(ctx, "tcp", l.Addr().String(), ccfg)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestHandshakeDeadlineIsCleared(t *testing.T) {
+	config := &Config{HandshakeTimeout: 50 * time.Millisecond}
+
+	l, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		o, err := l.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer o.Close()
+
+		wo, err := NewServer(o, config)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		buf := make([]byte, 5)
+
+		n, err := wo.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf[:n]))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	wc, err := DialContext(ctx, "tcp", l.Addr().String(), config)
+	assert.NoError(t, err)
+	defer wc.Close()
+
+	// Neither the timeout nor cancelling the context may affect the
+	// connection once it's established.
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = wc.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	wg.Wait()
+}
@@ -0,0 +1,220 @@
+package seconn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/vektra/errors"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+var ErrNoPeerIdentity = errors.New("peer did not present an identity")
+
+var ErrBadIdentity = errors.New("peer identity proof is invalid")
+
+var ErrUnsupportedIdentity = errors.New("unsupported identity key type")
+
+// The kinds of identity key carried in an identity message
+const (
+	identityNone    uint8 = 0
+	identityEd25519 uint8 = 1
+	identityX25519  uint8 = 2
+)
+
+// The data signed or MACed to prove possession of an identity key. It
+// covers the transcript up to the server hello and the sender's role, so
+// a proof can't be replayed on another connection or reflected back.
+func (c *Conn) identityContext(server bool) []byte {
+	role := "client"
+	if server {
+		role = "server"
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString("seconn identity ")
+	buf.WriteString(role)
+	buf.Write(c.handshakeHash)
+
+	return buf.Bytes()
+}
+
+func x25519Proof(shared, context []byte) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write(context)
+	return mac.Sum(nil)
+}
+
+// Build the body of our identity message: a type byte, the public key
+// and a proof that we hold the private key.
+func (c *Conn) marshalIdentity() ([]byte, error) {
+	context := c.identityContext(c.server)
+
+	switch key := c.config.identity().(type) {
+	case nil:
+		return []byte{identityNone}, nil
+	case ed25519.PrivateKey:
+		var buf bytes.Buffer
+
+		buf.WriteByte(identityEd25519)
+		buf.Write(key.Public().(ed25519.PublicKey))
+		buf.Write(ed25519.Sign(key, context))
+
+		return buf.Bytes(), nil
+	case *KeyPair:
+		var shared [32]byte
+
+		// Only the holder of the peer's ephemeral private key can
+		// compute this, so the proof is only good for this connection.
+		curve25519.ScalarMult(&shared, key.Private, c.peerKey)
+
+		var buf bytes.Buffer
+
+		buf.WriteByte(identityX25519)
+		buf.Write((*key.Public)[:])
+		buf.Write(x25519Proof(shared[:], context))
+
+		return buf.Bytes(), nil
+	default:
+		return nil, ErrUnsupportedIdentity
+	}
+}
+
+// Check the proof in the peer's identity message, returning their
+// public key. Returns nil if the peer didn't send one.
+func (c *Conn) unmarshalIdentity(data []byte) (crypto.PublicKey, error) {
+	if len(data) < 1 {
+		return nil, ErrProtocolError
+	}
+
+	context := c.identityContext(!c.server)
+
+	switch data[0] {
+	case identityNone:
+		if len(data) != 1 {
+			return nil, ErrProtocolError
+		}
+
+		return nil, nil
+	case identityEd25519:
+		data = data[1:]
+
+		if len(data) != ed25519.PublicKeySize+ed25519.SignatureSize {
+			return nil, ErrMalformedKey
+		}
+
+		pub := ed25519.PublicKey(data[:ed25519.PublicKeySize])
+
+		if !ed25519.Verify(pub, context, data[ed25519.PublicKeySize:]) {
+			return nil, ErrBadIdentity
+		}
+
+		return pub, nil
+	case identityX25519:
+		data = data[1:]
+
+		if len(data) != cKeySize+sha256.Size {
+			return nil, ErrMalformedKey
+		}
+
+		pub := new([32]byte)
+		copy((*pub)[:], data[:cKeySize])
+
+		var shared [32]byte
+
+		err := sharedSecret(&shared, c.privKey, pub)
+		if err != nil {
+			return nil, err
+		}
+
+		if !hmac.Equal(x25519Proof(shared[:], context), data[cKeySize:]) {
+			return nil, ErrBadIdentity
+		}
+
+		return pub, nil
+	default:
+		return nil, ErrUnsupportedIdentity
+	}
+}
+
+// Send our identity, sealed with key so that only the peer can see it
+func (c *Conn) sendIdentity(key []byte) error {
+	body, err := c.marshalIdentity()
+	if err != nil {
+		return err
+	}
+
+	aead, err := c.suite.New(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	return c.writeHandshake(msgIdentity, aead.Seal(nil, nonce, body, nil))
+}
+
+// Read the peer's identity and verify it before anything else happens
+func (c *Conn) readIdentity(key []byte) error {
+	msg, err := c.readHandshake(msgIdentity)
+	if err != nil {
+		return err
+	}
+
+	aead, err := c.suite.New(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	body, err := aead.Open(nil, nonce, msg, nil)
+	if err != nil {
+		return ErrHandshakeFailed
+	}
+
+	pub, err := c.unmarshalIdentity(body)
+	if err != nil {
+		return err
+	}
+
+	return c.verifyPeerIdentity(pub)
+}
+
+func (c *Conn) verifyPeerIdentity(pub crypto.PublicKey) error {
+	c.peerIdentity = pub
+
+	verify := c.config.verifyPeerIdentity()
+	if verify == nil {
+		return nil
+	}
+
+	if pub == nil {
+		return ErrNoPeerIdentity
+	}
+
+	err := verify(pub)
+	if err != nil {
+		c.authFailed = true
+	}
+
+	return err
+}
+
+// Derive the keys that protect the identity messages, server first
+func (c *Conn) identityKeys() [][]byte {
+	info := append([]byte("seconn identity "), c.handshakeHash...)
+
+	return makeKeys((*c.shared)[:], c.handshakeSalt, info, c.suite.KeySize)
+}
+
+// Return the identity key the peer proved it holds during the
+// handshake. This is an ed25519.PublicKey or, for X25519 identities and
+// noise static keys, a *[32]byte. Returns nil if the peer had none.
+func (c *Conn) PeerIdentity() crypto.PublicKey {
+	return c.peerIdentity
+}
@@ -0,0 +1,171 @@
+package seconn
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityEd25519(t *testing.T) {
+	spub, spriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	cpub, cpriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	var seenByClient, seenByServer crypto.PublicKey
+
+	scfg := &Config{
+		Identity: spriv,
+		VerifyPeerIdentity: func(key crypto.PublicKey) error {
+			seenByServer = key
+			return nil
+		},
+	}
+
+	ccfg := &Config{
+		Identity: cpriv,
+		VerifyPeerIdentity: func(key crypto.PublicKey) error {
+			seenByClient = key
+			return nil
+		},
+	}
+
+	wo, wc, serr, cerr := negotiatePair(t, scfg, ccfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	assert.Equal(t, spub, seenByClient)
+	assert.Equal(t, cpub, seenByServer)
+	assert.Equal(t, spub, wc.PeerIdentity())
+	assert.Equal(t, cpub, wo.PeerIdentity())
+}
+
+func TestIdentityX25519(t *testing.T) {
+	serverKey, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	wo, wc, serr, cerr := negotiatePair(t, &Config{Identity: serverKey}, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	assert.Equal(t, serverKey.Public, wc.PeerIdentity())
+	assert.Nil(t, wo.PeerIdentity())
+}
+
+func TestIdentityRequiredButMissing(t *testing.T) {
+	ccfg := &Config{
+		VerifyPeerIdentity: func(key crypto.PublicKey) error {
+			return nil
+		},
+	}
+
+	_, _, serr, cerr := negotiatePair(t, nil, ccfg)
+	assert.Error(t, serr)
+	assert.Equal(t, ErrNoPeerIdentity, cerr)
+}
+
+func TestIdentityRejected(t *testing.T) {
+	_, spriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	errUnknown := errors.New("unknown server")
+
+	ccfg := &Config{
+		VerifyPeerIdentity: func(key crypto.PublicKey) error {
+			return errUnknown
+		},
+	}
+
+	_, _, serr, cerr := negotiatePair(t, &Config{Identity: spriv}, ccfg)
+	assert.Error(t, serr)
+	assert.Equal(t, errUnknown, cerr)
+}
+
+func TestIdentityProofIsChecked(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	kp, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	ephemeral, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	server := &Conn{
+		server:        true,
+		handshakeHash: []byte("transcript"),
+		privKey:       ephemeral.Private,
+		peerKey:       ephemeral.Public,
+	}
+
+	client := &Conn{
+		handshakeHash: []byte("transcript"),
+		privKey:       ephemeral.Private,
+		peerKey:       ephemeral.Public,
+	}
+
+	for _, identity := range []crypto.PrivateKey{priv, kp} {
+		server.config = &Config{Identity: identity}
+
+		body, err := server.marshalIdentity()
+		require.NoError(t, err)
+
+		_, err = client.unmarshalIdentity(body)
+		assert.NoError(t, err)
+
+		// A proof made by the client can't be reflected back to it
+		_, err = server.unmarshalIdentity(body)
+		assert.Equal(t, ErrBadIdentity, err)
+
+		body[len(body)-1] ^= 0xff
+
+		_, err = client.unmarshalIdentity(body)
+		assert.Equal(t, ErrBadIdentity, err)
+	}
+}
+
+func TestIdentityWithNoise(t *testing.T) {
+	serverKey, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	clientKey, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	var seen crypto.PublicKey
+
+	scfg := &Config{
+		Identity: serverKey,
+		Noise:    &NoiseConfig{Pattern: NoiseXX},
+		VerifyPeerIdentity: func(key crypto.PublicKey) error {
+			seen = key
+			return nil
+		},
+	}
+
+	ccfg := &Config{
+		Identity: clientKey,
+		Noise:    &NoiseConfig{Pattern: NoiseXX},
+	}
+
+	wo, wc, serr, cerr := negotiatePair(t, scfg, ccfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	assert.Equal(t, clientKey.Public, seen)
+	assert.Equal(t, serverKey.Public, wc.PeerIdentity())
+}
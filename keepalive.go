@@ -0,0 +1,217 @@
+package seconn
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vektra/errors"
+)
+
+var (
+	ErrPeerTimeout     = errors.New("peer stopped answering keepalives")
+	ErrPeerClosedWrite = errors.New("peer closed the connection for writing")
+)
+
+// The state used by Ping and keepalives
+type pinger struct {
+	lock    sync.Mutex
+	nextID  uint64
+	waiting map[uint64]chan struct{}
+
+	// Set to 1 when keepalives gave up on the peer
+	timedOut int32
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Send an encrypted ping and wait for the peer to answer it, returning
+// the round trip time. Pongs are processed by Read, so Ping only
+// returns once something reads from the connection. A peer that has
+// called CloseWrite can't answer, so Ping returns ErrPeerClosedWrite.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	c.ping.lock.Lock()
+
+	if c.ping.waiting == nil {
+		c.ping.waiting = make(map[uint64]chan struct{})
+	}
+
+	id := c.ping.nextID
+	c.ping.nextID++
+
+	pong := make(chan struct{})
+	c.ping.waiting[id] = pong
+
+	c.ping.lock.Unlock()
+
+	defer func() {
+		c.ping.lock.Lock()
+		delete(c.ping.waiting, id)
+		c.ping.lock.Unlock()
+	}()
+
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, id)
+
+	start := time.Now()
+
+	// Send from another goroutine, so that a Write blocked on a peer
+	// that stopped reading can't keep us from giving up when ctx is done.
+	sent := make(chan error, 1)
+
+	go func() {
+		c.writeLock.Lock()
+		defer c.writeLock.Unlock()
+
+		if c.peerClosed {
+			sent <- ErrPeerClosedWrite
+			return
+		}
+
+		sent <- c.writeRecord(pPing, payload)
+	}()
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			return 0, err
+		}
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (c *Conn) readPing(cnt uint32) error {
+	buf, err := c.readAndCheck(cnt)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) != 8 {
+		return ErrProtocolError
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	err = c.writeRecord(pPong, buf)
+
+	// A peer that half closed can still ping us, but we can't answer
+	if err == ErrWriteClosed {
+		return nil
+	}
+
+	return err
+}
+
+func (c *Conn) readPong(cnt uint32) error {
+	buf, err := c.readAndCheck(cnt)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) != 8 {
+		return ErrProtocolError
+	}
+
+	id := binary.BigEndian.Uint64(buf)
+
+	c.ping.lock.Lock()
+	defer c.ping.lock.Unlock()
+
+	// Pongs for pings that were given up on are ignored
+	if pong, ok := c.ping.waiting[id]; ok {
+		close(pong)
+		delete(c.ping.waiting, id)
+	}
+
+	return nil
+}
+
+// Start sending keepalives, if they're configured
+func (c *Conn) startKeepalive() {
+	interval := c.config.keepaliveInterval()
+	if interval <= 0 {
+		return
+	}
+
+	c.ping.stop = make(chan struct{})
+
+	go c.keepalive(interval, c.config.keepaliveTimeout(), c.ping.stop)
+}
+
+func (c *Conn) stopKeepalive() {
+	if c.ping.stop == nil {
+		return
+	}
+
+	c.ping.stopOnce.Do(func() {
+		close(c.ping.stop)
+	})
+}
+
+func (c *Conn) keepalive(interval, timeout time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		_, err := c.Ping(ctx)
+
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		// Once either side has half closed, pongs can't come back
+		if err == ErrWriteClosed || err == ErrPeerClosedWrite {
+			return
+		}
+
+		if err != nil {
+			// Closing the connection unblocks any Read or Write,
+			// which then report ErrPeerTimeout.
+			atomic.StoreInt32(&c.ping.timedOut, 1)
+			c.Conn.Close()
+			return
+		}
+	}
+}
+
+// Report ErrPeerTimeout in place of the error caused by keepalives
+// closing the connection.
+func (c *Conn) keepaliveError(err error) error {
+	if err != nil && atomic.LoadInt32(&c.ping.timedOut) == 1 {
+		return ErrPeerTimeout
+	}
+
+	return err
+}
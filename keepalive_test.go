@@ -0,0 +1,209 @@
+package seconn
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPing(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	// Both sides have to be reading, one to answer and one to see the pong
+	go ioutil.ReadAll(wo)
+	go ioutil.ReadAll(wc)
+
+	for i := 0; i < 3; i++ {
+		rtt, err := wc.Ping(context.Background())
+		require.NoError(t, err)
+		assert.True(t, rtt > 0)
+	}
+}
+
+func TestPingContext(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	go ioutil.ReadAll(wc)
+
+	// The server isn't reading, so the ping is never answered
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := wc.Ping(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestKeepaliveDetectsDeadPeer(t *testing.T) {
+	ccfg := &Config{
+		KeepaliveInterval: 20 * time.Millisecond,
+		KeepaliveTimeout:  50 * time.Millisecond,
+	}
+
+	wo, wc, serr, cerr := negotiatePair(t, nil, ccfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	// The server never reads, so it never answers
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := wc.Read(make([]byte, 5))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrPeerTimeout, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read didn't fail after the peer stopped answering")
+	}
+
+	_, err := wc.Write([]byte("hello"))
+	assert.Equal(t, ErrPeerTimeout, err)
+}
+
+func TestKeepaliveHealthyPeer(t *testing.T) {
+	cfg := &Config{
+		KeepaliveInterval: 10 * time.Millisecond,
+		KeepaliveTimeout:  time.Second,
+	}
+
+	wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+
+	serverDone := make(chan error, 1)
+
+	go func() {
+		_, err := ioutil.ReadAll(wo)
+		serverDone <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := wo.Write([]byte("still here"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 10)
+
+	_, err = io.ReadFull(wc, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "still here", string(buf))
+
+	wc.Close()
+
+	assert.NoError(t, <-serverDone)
+}
+
+func TestKeepaliveHalfClose(t *testing.T) {
+	cfg := &Config{
+		KeepaliveInterval: 20 * time.Millisecond,
+		KeepaliveTimeout:  50 * time.Millisecond,
+	}
+
+	wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	require.NoError(t, wc.CloseWrite())
+
+	serverDone := make(chan error, 1)
+
+	// The server keeps sending well past the keepalive timeout, while
+	// neither side can get pongs back.
+	go func() {
+		_, err := ioutil.ReadAll(wo)
+		if err != nil {
+			serverDone <- err
+			return
+		}
+
+		for i := 0; i < 20; i++ {
+			time.Sleep(10 * time.Millisecond)
+
+			_, err = wo.Write([]byte("x"))
+			if err != nil {
+				serverDone <- err
+				return
+			}
+		}
+
+		serverDone <- wo.Close()
+	}()
+
+	data, err := ioutil.ReadAll(wc)
+	require.NoError(t, err)
+	assert.Equal(t, 20, len(data))
+
+	assert.NoError(t, <-serverDone)
+}
+
+func TestKeepaliveBlockedWrite(t *testing.T) {
+	ccfg := &Config{
+		KeepaliveInterval: 20 * time.Millisecond,
+		KeepaliveTimeout:  50 * time.Millisecond,
+	}
+
+	wo, wc, serr, cerr := negotiatePair(t, nil, ccfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	// The server never reads, so this fills the socket buffers and
+	// blocks while holding the write lock.
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := wc.Write(make([]byte, 64<<20))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrPeerTimeout, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepalives didn't notice the peer while a Write was blocked")
+	}
+}
+
+func TestPingPeerClosedWrite(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	require.NoError(t, wo.CloseWrite())
+
+	_, err := ioutil.ReadAll(wc)
+	require.NoError(t, err)
+
+	_, err = wc.Ping(context.Background())
+	assert.Equal(t, ErrPeerClosedWrite, err)
+}
@@ -0,0 +1,89 @@
+package seconn
+
+import "sync/atomic"
+
+// A key update replaces the key for one direction without involving the
+// peer. The sender derives the next key from the current one, sends an
+// empty pKeyUpdate record and seals everything after it with the new
+// key. The peer derives the same key when it reads the record. The old
+// key can't be recovered from the new one, so this gives cheap forward
+// secrecy, while a rekey is still needed to recover from a key being
+// stolen.
+
+// The key that replaces key after a key update
+func nextTrafficKey(key []byte) []byte {
+	return makeKeys(key, nil, []byte("seconn key update"), len(key))[0]
+}
+
+// Replace the key for our direction right away
+func (c *Conn) UpdateKey() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	return c.updateKey()
+}
+
+// Send a key update if the current key has been used for enough bytes.
+// The caller must hold writeLock.
+func (c *Conn) checkKeyUpdate() error {
+	after := c.config.keyUpdateAfterBytes()
+
+	if after <= 0 || atomic.LoadInt64(&c.write.bytes) < int64(after) {
+		return nil
+	}
+
+	return c.updateKey()
+}
+
+// The caller must hold writeLock.
+func (c *Conn) updateKey() error {
+	err := c.writeRecord(pKeyUpdate, nil)
+	if err != nil {
+		return err
+	}
+
+	err = c.write.ratchet(c.suite)
+	if err != nil {
+		return err
+	}
+
+	c.keyChanged(RekeyKeyUpdate)
+
+	return nil
+}
+
+func (c *Conn) readKeyUpdate(cnt uint32) error {
+	buf, err := c.readAndCheck(cnt)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) != 0 {
+		return ErrProtocolError
+	}
+
+	err = c.read.ratchet(c.suite)
+	if err != nil {
+		return err
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.keyChanged(RekeyKeyUpdate)
+
+	return nil
+}
+
+// Switch to the key following the current one, forgetting the old one
+func (h *half) ratchet(suite *CipherSuite) error {
+	old := h.key
+
+	err := h.setup(suite, nextTrafficKey(old), nil)
+
+	for i := range old {
+		old[i] = 0
+	}
+
+	return err
+}
@@ -0,0 +1,129 @@
+package seconn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyUpdate(t *testing.T) {
+	for _, cfg := range []*Config{nil, {MaxVersion: Version1}} {
+		wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+		require.NoError(t, serr)
+		require.NoError(t, cerr)
+
+		firstKey := append([]byte(nil), wc.write.key...)
+		firstShared := *wc.shared
+
+		var wg sync.WaitGroup
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, 5)
+
+			for i := 0; i < 3; i++ {
+				_, err := io.ReadFull(wo, buf)
+				assert.NoError(t, err)
+				assert.Equal(t, "hello", string(buf))
+			}
+		}()
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, wc.UpdateKey())
+
+			_, err := wc.Write([]byte("hello"))
+			require.NoError(t, err)
+		}
+
+		wg.Wait()
+
+		assert.NotEqual(t, firstKey, wc.write.key)
+		assert.Equal(t, wc.write.key, wo.read.key)
+
+		// Only our direction changed, and without a rekey
+		assert.Equal(t, firstShared, *wc.shared)
+		assert.Equal(t, wo.write.key, wc.read.key)
+
+		wo.Close()
+		wc.Close()
+	}
+}
+
+func TestKeyUpdateForgetsOldKey(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	old := wc.write.key
+	expected := nextTrafficKey(old)
+
+	require.NoError(t, wc.UpdateKey())
+
+	assert.Equal(t, expected, wc.write.key)
+	assert.Equal(t, make([]byte, len(old)), old)
+}
+
+func TestKeyUpdateAfterBytes(t *testing.T) {
+	cfg := &Config{
+		WriteBufferSize:     256,
+		KeyUpdateAfterBytes: 1024,
+		RekeyAfterBytes:     16 * 1024,
+	}
+
+	wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	data := make([]byte, 64*1024)
+
+	_, err := io.ReadFull(rand.Reader, data)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	// Key updates happen in both directions, in between rekeys
+	for _, pair := range [][2]*Conn{{wo, wc}, {wc, wo}} {
+		from, to := pair[0], pair[1]
+
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			for sent := 0; sent < len(data); sent += 4096 {
+				_, err := from.Write(data[sent : sent+4096])
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				sent, _ := from.KeyUsage()
+				assert.True(t, sent <= 1024+256)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, len(data))
+
+			_, err := io.ReadFull(to, buf)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(data, buf))
+		}()
+	}
+
+	wg.Wait()
+}
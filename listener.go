@@ -0,0 +1,171 @@
+package seconn
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// A net.Listener whose Accept returns connections that have already
+// completed the handshake as the server. Handshakes run in their own
+// goroutines, so a slow or silent client doesn't hold up the others;
+// set Config.HandshakeTimeout to bound how long each may take. Set
+// Config.VerifyConnection to check each connection, for instance with
+// an exchange from the auth package, before Accept returns it.
+type Listener struct {
+	net.Listener
+	config *Config
+
+	// If not nil, called with the error whenever a connection is dropped
+	// because its handshake, including VerifyConnection, failed. Must be
+	// set before the first call to Accept.
+	HandshakeError func(addr net.Addr, err error)
+
+	start sync.Once
+	stop  sync.Once
+
+	conns chan *Conn
+	done  chan struct{}
+
+	acceptErr chan struct{}
+	err       error
+}
+
+// Listen on addr and return a Listener that negotiates each incoming
+// connection using config, which may be nil.
+func Listen(network, addr string, config *Config) (*Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewListener(l, config), nil
+}
+
+// Wrap an existing net.Listener so that its connections are negotiated
+// using config, which may be nil.
+func NewListener(l net.Listener, config *Config) *Listener {
+	return &Listener{
+		Listener:  l,
+		config:    config,
+		conns:     make(chan *Conn),
+		done:      make(chan struct{}),
+		acceptErr: make(chan struct{}),
+	}
+}
+
+// Connect to addr on the named network and negotiate as the client
+func Dial(network, addr string, config *Config) (*Conn, error) {
+	return DialContext(context.Background(), network, addr, config)
+}
+
+// Wait for the next connection that completes its handshake
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.AcceptConn()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Like Accept, but returns the *Conn
+func (l *Listener) AcceptConn() (*Conn, error) {
+	l.start.Do(func() {
+		go l.serve()
+	})
+
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.acceptErr:
+		return nil, l.err
+	}
+}
+
+// Stop listening. Connections still in their handshake are closed.
+func (l *Listener) Close() error {
+	l.stop.Do(func() {
+		close(l.done)
+	})
+
+	return l.Listener.Close()
+}
+
+func (l *Listener) serve() {
+	var delay time.Duration
+
+	for {
+		u, err := l.Listener.Accept()
+		if err != nil {
+			// Ride out things like running out of file descriptors,
+			// backing off the same way net/http does.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+
+				if delay > time.Second {
+					delay = time.Second
+				}
+
+				select {
+				case <-time.After(delay):
+					continue
+				case <-l.done:
+				}
+			}
+
+			l.err = err
+			close(l.acceptErr)
+			return
+		}
+
+		delay = 0
+
+		go l.handshake(u)
+	}
+}
+
+func (l *Listener) handshake(u net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Give up on the handshake if the listener is closed under us
+	go func() {
+		select {
+		case <-l.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	c, err := NewConn(u, l.config)
+	if err != nil {
+		u.Close()
+		l.handshakeFailed(u.RemoteAddr(), err)
+		return
+	}
+
+	err = c.NegotiateContext(ctx, true)
+	if err != nil {
+		c.Close()
+		l.handshakeFailed(u.RemoteAddr(), err)
+		return
+	}
+
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *Listener) handshakeFailed(addr net.Addr, err error) {
+	if l.HandshakeError != nil {
+		l.HandshakeError(addr, err)
+	}
+}
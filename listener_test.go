@@ -0,0 +1,214 @@
+package seconn
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerAndDial(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		wc, err := Dial("tcp", l.Addr().String(), nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer wc.Close()
+
+		wc.Write([]byte("hello"))
+	}()
+
+	c, err := l.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+
+	assert.IsType(t, &Conn{}, c)
+
+	buf := make([]byte, 5)
+
+	n, err := c.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestListenerSlowClientDoesntBlock(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Connects but never starts the handshake
+	slow, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer slow.Close()
+
+	go func() {
+		wc, err := Dial("tcp", l.Addr().String(), nil)
+		if assert.NoError(t, err) {
+			wc.Close()
+		}
+	}()
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		c, err := l.AcceptConn()
+		if err == nil {
+			c.Close()
+		}
+
+		accepted <- err
+	}()
+
+	select {
+	case err := <-accepted:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept was blocked by a slow client")
+	}
+}
+
+func TestListenerVerifyConnection(t *testing.T) {
+	errRejected := errors.New("rejected")
+
+	var lock sync.Mutex
+	rejected := false
+
+	verified := make(chan *Conn, 2)
+
+	// Reject whichever connection gets here first
+	cfg := &Config{
+		KeepaliveInterval: time.Minute,
+		VerifyConnection: func(c *Conn) error {
+			lock.Lock()
+			defer lock.Unlock()
+
+			if !rejected {
+				rejected = true
+				verified <- c
+				return errRejected
+			}
+
+			return nil
+		},
+	}
+
+	l, err := Listen("tcp", "127.0.0.1:0", cfg)
+	require.NoError(t, err)
+	defer l.Close()
+
+	failures := make(chan error, 1)
+
+	l.HandshakeError = func(addr net.Addr, err error) {
+		failures <- err
+	}
+
+	alerts := make(chan error, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			wc, err := Dial("tcp", l.Addr().String(), nil)
+			if assert.NoError(t, err) {
+				defer wc.Close()
+
+				_, err = wc.Read(make([]byte, 1))
+				alerts <- err
+			}
+		}()
+	}
+
+	c, err := l.AcceptConn()
+	require.NoError(t, err)
+
+	assert.Equal(t, errRejected, <-failures)
+
+	// The rejected client hears why it was dropped
+	err = <-alerts
+	if assert.IsType(t, &AlertError{}, err) {
+		assert.Equal(t, AlertAuthFailed, err.(*AlertError).Code)
+	}
+
+	c.Close()
+
+	// Nothing outlives the rejected connection
+	r := <-verified
+
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	assert.Nil(t, r.ping.stop)
+	assert.Nil(t, r.rekeyTimer)
+}
+
+// Fails Accept with a temporary error a few times before working
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func (f *flakyListener) Accept() (net.Conn, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, tempError{}
+	}
+
+	return f.Listener.Accept()
+}
+
+func TestListenerRetriesTemporaryErrors(t *testing.T) {
+	u, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	l := NewListener(&flakyListener{Listener: u, failures: 3}, nil)
+	defer l.Close()
+
+	go func() {
+		wc, err := Dial("tcp", l.Addr().String(), nil)
+		if assert.NoError(t, err) {
+			defer wc.Close()
+			wc.Read(make([]byte, 1))
+		}
+	}()
+
+	c, err := l.AcceptConn()
+	require.NoError(t, err)
+
+	c.Close()
+}
+
+func TestListenerClose(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", nil)
+	require.NoError(t, err)
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, l.Close())
+
+	select {
+	case err := <-accepted:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept didn't return after Close")
+	}
+}
@@ -0,0 +1,590 @@
+package seconn
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/vektra/errors"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// A Noise Protocol Framework handshake pattern. See
+// http://noiseprotocol.org/noise.html for what each one provides.
+type NoisePattern uint8
+
+const (
+	// No static keys. Equivalent to the default handshake.
+	NoiseNN NoisePattern = iota + 1
+
+	// The initiator knows the responder's static key in advance.
+	NoiseNK
+
+	// Both sides transmit their static keys during the handshake.
+	NoiseXX
+
+	// The initiator knows the responder's static key and sends its own
+	// static key, hidden from passive observers, in the first message.
+	NoiseIK
+)
+
+func (p NoisePattern) String() string {
+	if def, ok := noisePatterns[p]; ok {
+		return def.name
+	}
+
+	return "unknown"
+}
+
+var ErrNoisePattern = errors.New("peer is not using the same noise pattern")
+
+var ErrMissingStaticKey = errors.New("noise pattern requires a static key")
+
+var ErrNoiseCipherSuite = errors.New("cipher suite can't be used with noise")
+
+// A curve25519 key pair, used as a long-term static key.
+type KeyPair struct {
+	Public  *[32]byte
+	Private *[32]byte
+}
+
+// Generate a new static key pair
+func GenerateKeyPair(rand io.Reader) (*KeyPair, error) {
+	pub, priv, err := GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyPair{Public: pub, Private: priv}, nil
+}
+
+// NoiseConfig selects a Noise handshake to use in place of the default
+// one. Both sides must use the same Pattern.
+type NoiseConfig struct {
+	Pattern NoisePattern
+
+	// Our long-term static key. Required by the responder for NK, XX
+	// and IK and by the initiator for XX and IK.
+	StaticKey *KeyPair
+
+	// The responder's static key, which the initiator must know in
+	// advance for NK and IK.
+	PeerStaticKey *[32]byte
+
+	// If not nil, called with the peer's static key as soon as it is
+	// received. Returning an error aborts the handshake.
+	VerifyPeerStatic func(key *[32]byte) error
+}
+
+type noiseToken uint8
+
+const (
+	tokE noiseToken = iota
+	tokS
+	tokEE
+	tokES
+	tokSE
+	tokSS
+)
+
+type noisePatternDef struct {
+	name string
+
+	// The responder's static key is known to the initiator in advance
+	responderPre bool
+
+	// Who needs a static key of their own
+	initiatorStatic bool
+	responderStatic bool
+
+	messages [][]noiseToken
+}
+
+var noisePatterns = map[NoisePattern]*noisePatternDef{
+	NoiseNN: {
+		name: "NN",
+		messages: [][]noiseToken{
+			{tokE},
+			{tokE, tokEE},
+		},
+	},
+	NoiseNK: {
+		name:            "NK",
+		responderPre:    true,
+		responderStatic: true,
+		messages: [][]noiseToken{
+			{tokE, tokES},
+			{tokE, tokEE},
+		},
+	},
+	NoiseXX: {
+		name:            "XX",
+		initiatorStatic: true,
+		responderStatic: true,
+		messages: [][]noiseToken{
+			{tokE},
+			{tokE, tokEE, tokS, tokES},
+			{tokS, tokSE},
+		},
+	},
+	NoiseIK: {
+		name:            "IK",
+		responderPre:    true,
+		initiatorStatic: true,
+		responderStatic: true,
+		messages: [][]noiseToken{
+			{tokE, tokES, tokS, tokSS},
+			{tokE, tokEE, tokSE},
+		},
+	},
+}
+
+// The Noise names of the cipher suites that can be used with it
+var noiseCipherNames = map[uint16]string{
+	AES256GCM:        "AESGCM",
+	ChaCha20Poly1305: "ChaChaPoly",
+}
+
+// A Noise CipherState
+type noiseCipherState struct {
+	suite *CipherSuite
+	aead  cipher.AEAD
+	n     uint64
+}
+
+func (cs *noiseCipherState) initializeKey(key []byte) error {
+	aead, err := cs.suite.New(key[:cs.suite.KeySize])
+	if err != nil {
+		return err
+	}
+
+	cs.aead = aead
+	cs.n = 0
+
+	return nil
+}
+
+func (cs *noiseCipherState) hasKey() bool {
+	return cs.aead != nil
+}
+
+// AESGCM encodes the counter big endian, ChaChaPoly little endian
+func (cs *noiseCipherState) nonce() []byte {
+	nonce := make([]byte, cs.aead.NonceSize())
+
+	if cs.suite.ID == ChaCha20Poly1305 {
+		binary.LittleEndian.PutUint64(nonce[4:], cs.n)
+	} else {
+		binary.BigEndian.PutUint64(nonce[4:], cs.n)
+	}
+
+	return nonce
+}
+
+func (cs *noiseCipherState) encrypt(ad, plaintext []byte) []byte {
+	if !cs.hasKey() {
+		return plaintext
+	}
+
+	ct := cs.aead.Seal(nil, cs.nonce(), plaintext, ad)
+	cs.n++
+
+	return ct
+}
+
+func (cs *noiseCipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if !cs.hasKey() {
+		return ciphertext, nil
+	}
+
+	pt, err := cs.aead.Open(nil, cs.nonce(), ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.n++
+
+	return pt, nil
+}
+
+// A Noise SymmetricState, using SHA256
+type noiseSymmetricState struct {
+	cs noiseCipherState
+	ck []byte
+	h  []byte
+}
+
+func (ss *noiseSymmetricState) initialize(name string, suite *CipherSuite) {
+	if len(name) <= sha256.Size {
+		ss.h = make([]byte, sha256.Size)
+		copy(ss.h, name)
+	} else {
+		sum := sha256.Sum256([]byte(name))
+		ss.h = sum[:]
+	}
+
+	ss.ck = ss.h
+	ss.cs = noiseCipherState{suite: suite}
+}
+
+// The Noise HKDF is HKDF-SHA256 keyed by the chaining key with no info
+func (ss *noiseSymmetricState) hkdf(ikm []byte) ([]byte, []byte) {
+	r := hkdf.New(sha256.New, ikm, ss.ck, nil)
+
+	out := make([]byte, sha256.Size*2)
+
+	if _, err := io.ReadFull(r, out); err != nil {
+		panic("unable to derive key")
+	}
+
+	return out[:sha256.Size], out[sha256.Size:]
+}
+
+func (ss *noiseSymmetricState) mixKey(ikm []byte) error {
+	ck, key := ss.hkdf(ikm)
+	ss.ck = ck
+
+	return ss.cs.initializeKey(key)
+}
+
+func (ss *noiseSymmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h)
+	h.Write(data)
+	ss.h = h.Sum(nil)
+}
+
+func (ss *noiseSymmetricState) encryptAndHash(plaintext []byte) []byte {
+	ct := ss.cs.encrypt(ss.h, plaintext)
+	ss.mixHash(ct)
+	return ct
+}
+
+func (ss *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	pt, err := ss.cs.decrypt(ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	ss.mixHash(ciphertext)
+
+	return pt, nil
+}
+
+// Return the keys for the initiator and responder to send with
+func (ss *noiseSymmetricState) split() ([]byte, []byte) {
+	return ss.hkdf(nil)
+}
+
+// A Noise HandshakeState
+type noiseHandshake struct {
+	pattern   *noisePatternDef
+	initiator bool
+	rand      io.Reader
+
+	ss noiseSymmetricState
+
+	s  *KeyPair
+	e  *KeyPair
+	rs *[32]byte
+	re *[32]byte
+
+	verifyPeerStatic func(key *[32]byte) error
+
+	msg int
+}
+
+func newNoiseHandshake(cfg *NoiseConfig, suite *CipherSuite, initiator bool, prologue []byte, rand io.Reader) (*noiseHandshake, error) {
+	pattern, ok := noisePatterns[cfg.Pattern]
+	if !ok {
+		return nil, ErrNoisePattern
+	}
+
+	cipherName, ok := noiseCipherNames[suite.ID]
+	if !ok {
+		return nil, ErrNoiseCipherSuite
+	}
+
+	hs := &noiseHandshake{
+		pattern:          pattern,
+		initiator:        initiator,
+		rand:             rand,
+		s:                cfg.StaticKey,
+		verifyPeerStatic: cfg.VerifyPeerStatic,
+	}
+
+	if (initiator && pattern.initiatorStatic) || (!initiator && pattern.responderStatic) {
+		if hs.s == nil {
+			return nil, ErrMissingStaticKey
+		}
+	}
+
+	if initiator && pattern.responderPre {
+		if cfg.PeerStaticKey == nil {
+			return nil, ErrMissingStaticKey
+		}
+
+		hs.rs = cfg.PeerStaticKey
+	}
+
+	hs.ss.initialize("Noise_"+pattern.name+"_25519_"+cipherName+"_SHA256", suite)
+	hs.ss.mixHash(prologue)
+
+	if pattern.responderPre {
+		if initiator {
+			hs.ss.mixHash((*hs.rs)[:])
+		} else {
+			hs.ss.mixHash((*hs.s.Public)[:])
+		}
+	}
+
+	return hs, nil
+}
+
+func (hs *noiseHandshake) done() bool {
+	return hs.msg >= len(hs.pattern.messages)
+}
+
+// Is it our turn to write a message?
+func (hs *noiseHandshake) writing() bool {
+	return (hs.msg%2 == 0) == hs.initiator
+}
+
+// Perform the DH for es or se. Which keys are used depends on our role.
+func (hs *noiseHandshake) mixDH(tok noiseToken) error {
+	var priv, pub *[32]byte
+
+	switch tok {
+	case tokEE:
+		priv, pub = hs.e.Private, hs.re
+	case tokSS:
+		priv, pub = hs.s.Private, hs.rs
+	case tokES:
+		if hs.initiator {
+			priv, pub = hs.e.Private, hs.rs
+		} else {
+			priv, pub = hs.s.Private, hs.re
+		}
+	case tokSE:
+		if hs.initiator {
+			priv, pub = hs.s.Private, hs.re
+		} else {
+			priv, pub = hs.e.Private, hs.rs
+		}
+	default:
+		return ErrProtocolError
+	}
+
+	var shared [32]byte
+
+	err := sharedSecret(&shared, priv, pub)
+	if err != nil {
+		return err
+	}
+
+	return hs.ss.mixKey(shared[:])
+}
+
+func (hs *noiseHandshake) writeMessage(payload []byte) ([]byte, error) {
+	if hs.done() || !hs.writing() {
+		return nil, ErrProtocolError
+	}
+
+	var buf bytes.Buffer
+
+	for _, tok := range hs.pattern.messages[hs.msg] {
+		switch tok {
+		case tokE:
+			e, err := GenerateKeyPair(hs.rand)
+			if err != nil {
+				return nil, err
+			}
+
+			hs.e = e
+			buf.Write((*e.Public)[:])
+			hs.ss.mixHash((*e.Public)[:])
+		case tokS:
+			buf.Write(hs.ss.encryptAndHash((*hs.s.Public)[:]))
+		default:
+			err := hs.mixDH(tok)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	buf.Write(hs.ss.encryptAndHash(payload))
+
+	hs.msg++
+
+	return buf.Bytes(), nil
+}
+
+func (hs *noiseHandshake) readMessage(msg []byte) ([]byte, error) {
+	if hs.done() || hs.writing() {
+		return nil, ErrProtocolError
+	}
+
+	for _, tok := range hs.pattern.messages[hs.msg] {
+		switch tok {
+		case tokE:
+			if len(msg) < cKeySize {
+				return nil, ErrMalformedKey
+			}
+
+			hs.re = new([32]byte)
+			copy((*hs.re)[:], msg[:cKeySize])
+			msg = msg[cKeySize:]
+
+			hs.ss.mixHash((*hs.re)[:])
+		case tokS:
+			size := cKeySize
+			if hs.ss.cs.hasKey() {
+				size += hs.ss.cs.aead.Overhead()
+			}
+
+			if len(msg) < size {
+				return nil, ErrMalformedKey
+			}
+
+			key, err := hs.ss.decryptAndHash(msg[:size])
+			if err != nil {
+				return nil, ErrHandshakeFailed
+			}
+
+			msg = msg[size:]
+
+			hs.rs = new([32]byte)
+			copy((*hs.rs)[:], key)
+
+			if hs.verifyPeerStatic != nil {
+				if err := hs.verifyPeerStatic(hs.rs); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			err := hs.mixDH(tok)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	payload, err := hs.ss.decryptAndHash(msg)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+
+	hs.msg++
+
+	return payload, nil
+}
+
+// Run a noise handshake over the connection, using the hellos that have
+// already been exchanged as the prologue.
+func (c *Conn) noiseHandshake(cfg *NoiseConfig) error {
+	// Fall back to the connection's identity for the static key
+	if cfg.StaticKey == nil && c.config.identity() != nil {
+		kp, ok := c.config.identity().(*KeyPair)
+		if !ok {
+			return ErrUnsupportedIdentity
+		}
+
+		withIdentity := *cfg
+		withIdentity.StaticKey = kp
+		cfg = &withIdentity
+	}
+
+	if verify := cfg.VerifyPeerStatic; verify != nil {
+		withVerify := *cfg
+		withVerify.VerifyPeerStatic = func(key *[32]byte) error {
+			err := verify(key)
+			if err != nil {
+				c.authFailed = true
+			}
+
+			return err
+		}
+
+		cfg = &withVerify
+	}
+
+	hs, err := newNoiseHandshake(cfg, c.suite, !c.server, c.transcript.Sum(nil), c.config.rand())
+	if err != nil {
+		return err
+	}
+
+	for !hs.done() {
+		if hs.writing() {
+			msg, err := hs.writeMessage(nil)
+			if err != nil {
+				return err
+			}
+
+			err = c.writeHandshake(msgNoise, msg)
+			if err != nil {
+				return err
+			}
+		} else {
+			if hs.msg == len(hs.pattern.messages)-1 {
+				c.peerDone = true
+			}
+
+			msg, err := c.readHandshake(msgNoise)
+			if err != nil {
+				return err
+			}
+
+			payload, err := hs.readMessage(msg)
+			if err != nil {
+				return err
+			}
+
+			if len(payload) != 0 {
+				return ErrProtocolError
+			}
+		}
+	}
+
+	c.pubKey = hs.e.Public
+	c.privKey = hs.e.Private
+	c.peerKey = hs.re
+	c.peerStatic = hs.rs
+
+	// The handshake hash is public, so the secret the rest of the session
+	// derives from comes from the chaining key instead.
+	c.shared = new([32]byte)
+	copy((*c.shared)[:], makeKeys(hs.ss.ck, nil, []byte("seconn noise shared"), 32)[0])
+
+	c.handshakeHash = hs.ss.h
+	c.exporterSecret = deriveExporterSecret(hs.ss.ck, nil, hs.ss.h)
+
+	initiatorKey, responderKey := hs.ss.split()
+
+	// The peer may be done with the handshake and expecting records, so
+	// have the keys ready in case we need to send it an alert.
+	err = c.setupHalves([][]byte{
+		responderKey[:c.suite.KeySize],
+		initiatorKey[:c.suite.KeySize],
+	})
+	if err != nil {
+		return err
+	}
+
+	c.peerDone = true
+
+	if hs.rs != nil {
+		return c.verifyPeerIdentity(hs.rs)
+	}
+
+	return c.verifyPeerIdentity(nil)
+}
+
+// Return the static key the peer used during a noise handshake. Returns
+// nil for the default handshake or if the pattern didn't send one.
+func (c *Conn) PeerStaticKey() *[32]byte {
+	return c.peerStatic
+}
@@ -0,0 +1,299 @@
+package seconn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+type noiseVector map[string]string
+
+func loadNoiseVectors(t *testing.T) []noiseVector {
+	f, err := os.Open("testdata/noise_vectors.txt")
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	var vectors []noiseVector
+
+	cur := noiseVector{}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if line == "" {
+			if len(cur) > 0 {
+				vectors = append(vectors, cur)
+				cur = noiseVector{}
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		require.Len(t, parts, 2)
+
+		cur[parts[0]] = parts[1]
+	}
+
+	require.NoError(t, scanner.Err())
+
+	if len(cur) > 0 {
+		vectors = append(vectors, cur)
+	}
+
+	return vectors
+}
+
+func (v noiseVector) bytes(t *testing.T, key string) []byte {
+	b, err := hex.DecodeString(v[key])
+	require.NoError(t, err)
+	return b
+}
+
+func (v noiseVector) keyPair(t *testing.T, key string) *KeyPair {
+	if _, ok := v[key]; !ok {
+		return nil
+	}
+
+	kp := &KeyPair{Public: new([32]byte), Private: new([32]byte)}
+	copy((*kp.Private)[:], v.bytes(t, key))
+	curve25519.ScalarBaseMult(kp.Public, kp.Private)
+
+	return kp
+}
+
+func TestNoiseVectors(t *testing.T) {
+	patterns := map[string]NoisePattern{
+		"NN": NoiseNN,
+		"NK": NoiseNK,
+		"XX": NoiseXX,
+		"IK": NoiseIK,
+	}
+
+	suites := map[string]uint16{
+		"AESGCM":     AES256GCM,
+		"ChaChaPoly": ChaCha20Poly1305,
+	}
+
+	vectors := loadNoiseVectors(t)
+	require.Len(t, vectors, 32)
+
+	for _, v := range vectors {
+		parts := strings.Split(v["handshake"], "_")
+		require.Len(t, parts, 5)
+
+		suite := CipherSuiteByID(suites[parts[3]])
+		prologue := v.bytes(t, "prologue")
+
+		initStatic := v.keyPair(t, "init_static")
+		respStatic := v.keyPair(t, "resp_static")
+
+		icfg := &NoiseConfig{Pattern: patterns[parts[1]], StaticKey: initStatic}
+		rcfg := &NoiseConfig{Pattern: patterns[parts[1]], StaticKey: respStatic}
+
+		if respStatic != nil {
+			icfg.PeerStaticKey = respStatic.Public
+		}
+
+		init, err := newNoiseHandshake(icfg, suite, true, prologue,
+			bytes.NewReader(v.bytes(t, "gen_init_ephemeral")))
+		require.NoError(t, err)
+
+		resp, err := newNoiseHandshake(rcfg, suite, false, prologue,
+			bytes.NewReader(v.bytes(t, "gen_resp_ephemeral")))
+		require.NoError(t, err)
+
+		var initSend, respSend noiseCipherState
+
+		for i := 0; ; i++ {
+			payloadKey := "msg_" + strconv.Itoa(i) + "_payload"
+			if _, ok := v[payloadKey]; !ok {
+				break
+			}
+
+			payload := v.bytes(t, payloadKey)
+			expected := v.bytes(t, "msg_"+strconv.Itoa(i)+"_ciphertext")
+
+			writer, reader := init, resp
+			if i%2 == 1 {
+				writer, reader = resp, init
+			}
+
+			if !writer.done() {
+				ct, err := writer.writeMessage(payload)
+				require.NoError(t, err)
+				assert.Equal(t, expected, ct, "%s message %d", v["handshake"], i)
+
+				pt, err := reader.readMessage(ct)
+				require.NoError(t, err)
+				assert.True(t, bytes.Equal(payload, pt))
+
+				if init.done() {
+					ik, rk := init.ss.split()
+
+					initSend = noiseCipherState{suite: suite}
+					require.NoError(t, initSend.initializeKey(ik))
+
+					respSend = noiseCipherState{suite: suite}
+					require.NoError(t, respSend.initializeKey(rk))
+				}
+
+				continue
+			}
+
+			// Transport messages alternate starting with the initiator,
+			// no matter who sent the last handshake message.
+			send := &initSend
+			if (i-len(init.pattern.messages))%2 == 1 {
+				send = &respSend
+			}
+
+			ct := send.encrypt(nil, payload)
+			assert.Equal(t, expected, ct, "%s message %d", v["handshake"], i)
+		}
+
+		assert.True(t, init.done())
+		assert.True(t, resp.done())
+		assert.Equal(t, init.ss.h, resp.ss.h)
+	}
+}
+
+func TestNoiseHandshakes(t *testing.T) {
+	serverKey, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	clientKey, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	for _, pattern := range []NoisePattern{NoiseNN, NoiseNK, NoiseXX, NoiseIK} {
+		t.Run(pattern.String(), func(t *testing.T) {
+			def := noisePatterns[pattern]
+
+			scfg := &Config{Noise: &NoiseConfig{Pattern: pattern, StaticKey: serverKey}}
+
+			ccfg := &Config{Noise: &NoiseConfig{Pattern: pattern}}
+
+			if def.initiatorStatic {
+				ccfg.Noise.StaticKey = clientKey
+			}
+
+			if def.responderPre {
+				ccfg.Noise.PeerStaticKey = serverKey.Public
+			}
+
+			wo, wc, serr, cerr := negotiatePair(t, scfg, ccfg)
+			require.NoError(t, serr)
+			require.NoError(t, cerr)
+
+			defer wo.Close()
+			defer wc.Close()
+
+			assert.Equal(t, wo.handshakeHash, wc.handshakeHash)
+
+			// The shared secret is agreed, but isn't the public transcript hash
+			assert.Equal(t, *wo.shared, *wc.shared)
+			assert.NotEqual(t, wc.handshakeHash, (*wc.shared)[:])
+
+			if def.responderStatic {
+				assert.Equal(t, serverKey.Public, wc.PeerStaticKey())
+			} else {
+				assert.Nil(t, wc.PeerStaticKey())
+			}
+
+			if def.initiatorStatic {
+				assert.Equal(t, clientKey.Public, wo.PeerStaticKey())
+			} else {
+				assert.Nil(t, wo.PeerStaticKey())
+			}
+
+			go wo.Write([]byte("hello"))
+
+			buf := make([]byte, 5)
+
+			n, err := wc.Read(buf)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(buf[:n]))
+		})
+	}
+}
+
+func TestNoiseWrongPeerStaticKey(t *testing.T) {
+	serverKey, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	otherKey, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	scfg := &Config{Noise: &NoiseConfig{Pattern: NoiseNK, StaticKey: serverKey}}
+	ccfg := &Config{Noise: &NoiseConfig{Pattern: NoiseNK, PeerStaticKey: otherKey.Public}}
+
+	_, _, serr, _ := negotiatePair(t, scfg, ccfg)
+	assert.Equal(t, ErrHandshakeFailed, serr)
+}
+
+func TestNoiseVerifyPeerStatic(t *testing.T) {
+	serverKey, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	clientKey, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	errUnknown := errors.New("unknown key")
+
+	scfg := &Config{
+		Noise: &NoiseConfig{
+			Pattern:   NoiseXX,
+			StaticKey: serverKey,
+			VerifyPeerStatic: func(key *[32]byte) error {
+				if *key != *clientKey.Public {
+					return errUnknown
+				}
+
+				return nil
+			},
+		},
+	}
+
+	ccfg := &Config{
+		Noise: &NoiseConfig{
+			Pattern:   NoiseXX,
+			StaticKey: serverKey,
+		},
+	}
+
+	_, _, serr, _ := negotiatePair(t, scfg, ccfg)
+	assert.Equal(t, errUnknown, serr)
+}
+
+func TestNoisePatternMismatch(t *testing.T) {
+	serverKey, err := GenerateKeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	scfg := &Config{Noise: &NoiseConfig{Pattern: NoiseXX, StaticKey: serverKey}}
+
+	_, _, serr, cerr := negotiatePair(t, scfg, &Config{Noise: &NoiseConfig{Pattern: NoiseNN}})
+	assert.Equal(t, ErrNoisePattern, serr)
+	assert.Equal(t, ErrNoisePattern, cerr)
+
+	_, _, serr, cerr = negotiatePair(t, scfg, nil)
+	assert.Equal(t, ErrNoisePattern, serr)
+	assert.Equal(t, ErrNoisePattern, cerr)
+}
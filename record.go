@@ -0,0 +1,175 @@
+package seconn
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+)
+
+// The size of the header at the front of every record. In Version1 it
+// holds the record's command in the low byte and the payload length
+// above it. From Version2 on it holds only the payload length.
+const recordHeaderSize = 4
+
+// The largest payload length the header can hold
+const maxRecordField = 1<<24 - 1
+
+// Version1 seals the header and the payload as 2 separate AEAD messages.
+// From Version2 on, the header is sent in the clear and authenticated as
+// the associated data of the payload, so a record is sealed once and
+// goes out in a single write. The command then goes in the sealed part,
+// after the payload, like TLS 1.3's inner content type, so an observer
+// can't tell data from pings, rekeys or alerts.
+func (c *Conn) headerInClear() bool {
+	return c.version >= Version2
+}
+
+func (c *Conn) writeFull(b []byte) error {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		return err
+	}
+
+	if n != len(b) {
+		return io.ErrShortWrite
+	}
+
+	return nil
+}
+
+// Encrypt payload and send it as a record. The caller must hold writeLock.
+func (c *Conn) writeRecord(cmd uint32, payload []byte) error {
+	if c.peerAlert != nil {
+		return c.peerAlert
+	}
+
+	if c.closeSent {
+		return ErrWriteClosed
+	}
+
+	atomic.AddInt64(&c.write.bytes, int64(len(payload)))
+	atomic.AddInt64(&c.write.records, 1)
+
+	var header [recordHeaderSize]byte
+
+	if c.headerInClear() {
+		binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+
+		rec := append(c.recordBuf[:0], header[:]...)
+		rec = append(rec, payload...)
+		rec = append(rec, byte(cmd))
+
+		// Sealed in place, behind the header
+		rec = c.write.aead.Seal(rec[:recordHeaderSize], c.write.seq, rec[recordHeaderSize:], header[:])
+		c.write.incSeq()
+
+		c.recordBuf = rec[:0]
+
+		return c.writeFull(rec)
+	}
+
+	binary.BigEndian.PutUint32(header[:], cmd|uint32(len(payload))<<8)
+
+	ct := c.write.aead.Seal(c.writeBuf[:0], c.write.seq, header[:], nil)
+	c.write.incSeq()
+
+	err := c.writeFull(ct)
+	if err != nil {
+		return err
+	}
+
+	ct = c.write.aead.Seal(c.writeBuf[:0], c.write.seq, payload, nil)
+	c.write.incSeq()
+
+	return c.writeFull(ct)
+}
+
+// Read the header of the next record, returning its command and the
+// length of its payload. From Version2 on, the command is sealed with the
+// payload, so the whole record is read and opened here and its plaintext
+// left in readBuf.
+func (c *Conn) readHeader() (uint32, uint32, error) {
+	n, err := io.ReadFull(c.Conn, c.headerBuf)
+	if err != nil {
+		// The peer hung up without a close notify, so the stream may
+		// have been truncated.
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return 0, 0, err
+	}
+
+	if n != len(c.headerBuf) {
+		return 0, 0, io.ErrShortBuffer
+	}
+
+	if c.headerInClear() {
+		return c.readSealedRecord()
+	}
+
+	header, err := c.read.aead.Open(c.headerBuf[:0], c.read.seq, c.headerBuf, nil)
+	if err != nil {
+		return 0, 0, ErrBadHeader
+	}
+
+	c.read.incSeq()
+
+	cnt := binary.BigEndian.Uint32(header)
+
+	// Checked before anything is allocated for the payload
+	if int(cnt>>8) > c.config.maxRecordSize() {
+		return 0, 0, ErrRecordTooLarge
+	}
+
+	return cnt & 0xff, cnt >> 8, nil
+}
+
+// Read and open the rest of a Version2 record whose header is in
+// headerBuf, leaving its payload in readBuf.
+func (c *Conn) readSealedRecord() (uint32, uint32, error) {
+	cnt := binary.BigEndian.Uint32(c.headerBuf)
+
+	// Checked before anything is allocated for the payload
+	if cnt > maxRecordField || int(cnt) > c.config.maxRecordSize() {
+		return 0, 0, ErrRecordTooLarge
+	}
+
+	// The payload, then the command byte
+	wireCnt := int64(cnt) + 1 + int64(c.read.aead.Overhead())
+
+	_, err := io.CopyN(&c.readBuf, c.Conn, wireCnt)
+	if err != nil {
+		c.readBuf.Reset()
+
+		// A header followed by a hang up, which an attacker can forge
+		// since the header is sent in the clear.
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return 0, 0, err
+	}
+
+	pt, err := c.read.aead.Open(
+		c.readBuf.Bytes()[:0],
+		c.read.seq,
+		c.readBuf.Bytes(),
+		c.headerBuf,
+	)
+
+	if err != nil {
+		c.readBuf.Reset()
+		return 0, 0, ErrDecryptFailed
+	}
+
+	c.read.incSeq()
+
+	cmd := pt[len(pt)-1]
+
+	// Because we rewrite the buffer to contain the plaintext, we need to truncate
+	// it to that size since otherwise it will still contain some of the ciphertext
+	c.readBuf.Truncate(len(pt) - 1)
+
+	return uint32(cmd), cnt, nil
+}
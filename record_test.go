@@ -0,0 +1,398 @@
+package seconn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Counts the writes made to the wrapped connection, optionally keeping
+// what was written instead of sending it.
+type countingConn struct {
+	net.Conn
+
+	writes int
+	hold   bool
+	held   bytes.Buffer
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes++
+
+	if c.hold {
+		return c.held.Write(b)
+	}
+
+	return c.Conn.Write(b)
+}
+
+func TestRecordVersions(t *testing.T) {
+	v1 := &Config{MaxVersion: Version1}
+
+	pairs := []struct {
+		name     string
+		scfg     *Config
+		ccfg     *Config
+		expected uint16
+	}{
+		{"v1", v1, v1, Version1},
+		{"old client", nil, v1, Version1},
+		{"old server", v1, nil, Version1},
+		{"v2", nil, nil, Version2},
+	}
+
+	for _, pair := range pairs {
+		t.Run(pair.name, func(t *testing.T) {
+			wo, wc, serr, cerr := negotiatePair(t, pair.scfg, pair.ccfg)
+			require.NoError(t, serr)
+			require.NoError(t, cerr)
+
+			defer wo.Close()
+			defer wc.Close()
+
+			assert.Equal(t, pair.expected, wo.Version())
+			assert.Equal(t, pair.expected, wc.Version())
+
+			msgs := []string{"hello 1", "hello 2", "hello 3"}
+
+			var wg sync.WaitGroup
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				buf := make([]byte, 7)
+
+				for i, msg := range msgs {
+					n, err := wo.Read(buf)
+					assert.NoError(t, err)
+					assert.Equal(t, msg, string(buf[:n]))
+
+					if i < len(msgs)-2 {
+						wo.RekeyNext()
+					}
+
+					_, err = wo.Write(buf[:n])
+					assert.NoError(t, err)
+				}
+			}()
+
+			firstKey := *wc.shared
+
+			buf := make([]byte, 7)
+
+			for _, msg := range msgs {
+				_, err := wc.Write([]byte(msg))
+				assert.NoError(t, err)
+
+				n, err := wc.Read(buf)
+				assert.NoError(t, err)
+				assert.Equal(t, msg, string(buf[:n]))
+			}
+
+			wg.Wait()
+
+			assert.NotEqual(t, firstKey, *wc.shared)
+		})
+	}
+}
+
+func TestRecordSingleWrite(t *testing.T) {
+	for version, expected := range map[uint16]int{Version1: 2, Version2: 1} {
+		cfg := &Config{MaxVersion: version}
+
+		wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+		require.NoError(t, serr)
+		require.NoError(t, cerr)
+
+		cc := &countingConn{Conn: wc.Conn}
+		wc.Conn = cc
+
+		_, err := wc.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		buf := make([]byte, 5)
+
+		n, err := wo.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf[:n]))
+
+		assert.Equal(t, expected, cc.writes, "version %d", version)
+
+		wo.Close()
+		wc.Close()
+	}
+}
+
+func TestRecordHeaderIsAuthenticated(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	require.Equal(t, Version2, wc.Version())
+
+	raw := wc.Conn
+
+	cc := &countingConn{Conn: raw, hold: true}
+	wc.Conn = cc
+
+	_, err := wc.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	rec := cc.held.Bytes()
+
+	// Change the length without touching the sealed part
+	rec[recordHeaderSize-1]--
+
+	_, err = raw.Write(rec)
+	require.NoError(t, err)
+
+	_, err = wo.Read(make([]byte, 5))
+	assert.Error(t, err)
+}
+
+func TestRecordHidesCommand(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	require.Equal(t, Version2, wc.Version())
+
+	cc := &countingConn{Conn: wc.Conn, hold: true}
+	wc.Conn = cc
+
+	payload := make([]byte, 8)
+
+	wc.writeLock.Lock()
+	require.NoError(t, wc.writeRecord(pData, payload))
+	data := append([]byte(nil), cc.held.Bytes()...)
+	cc.held.Reset()
+
+	require.NoError(t, wc.writeRecord(pStartRekey, payload))
+	rekey := cc.held.Bytes()
+	wc.writeLock.Unlock()
+
+	// Only the length is in the clear
+	assert.Equal(t, len(data), len(rekey))
+	assert.Equal(t, data[:recordHeaderSize], rekey[:recordHeaderSize])
+}
+
+func TestRecordEmptyReadKeepsData(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	go func() {
+		wc.Write([]byte("hello"))
+		wc.Write([]byte("world"))
+	}()
+
+	buf := make([]byte, 2)
+
+	_, err := io.ReadFull(wo, buf)
+	require.NoError(t, err)
+
+	// Must not start on the next record with "llo" still buffered
+	n, err := wo.Read(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	rest := make([]byte, 8)
+
+	_, err = io.ReadFull(wo, rest)
+	require.NoError(t, err)
+	assert.Equal(t, "lloworld", string(rest))
+}
+
+func TestRecordTooLarge(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	// A header claiming the largest possible payload, which must be
+	// rejected before anything is read or allocated for it.
+	_, err := wc.Conn.Write([]byte{0xff, 0xff, 0xff, byte(pData)})
+	require.NoError(t, err)
+
+	_, err = wo.Read(make([]byte, 10))
+	assert.Equal(t, ErrRecordTooLarge, err)
+}
+
+func TestRecordLimitIsAdvertised(t *testing.T) {
+	scfg := &Config{MaxRecordSize: 300}
+	ccfg := &Config{WriteBufferSize: 4096}
+
+	wo, wc, serr, cerr := negotiatePair(t, scfg, ccfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	cc := &countingConn{Conn: wc.Conn}
+	wc.Conn = cc
+
+	msg := bytes.Repeat([]byte("x"), 1000)
+
+	_, err := wc.Write(msg)
+	require.NoError(t, err)
+
+	// Split to fit the server's limit rather than our write buffer
+	assert.Equal(t, 4, cc.writes)
+
+	buf := make([]byte, len(msg))
+
+	_, err = io.ReadFull(wo, buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg, buf)
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	scfg := &Config{MaxMessageSize: 10}
+
+	wo, wc, serr, cerr := negotiatePair(t, scfg, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	assert.Equal(t, ErrMessageTooLarge, wc.SendMessage(make([]byte, 11)))
+
+	// A peer ignoring the limit is caught by GetMessage
+	err := binary.Write(wc, binary.BigEndian, uint32(1<<31))
+	require.NoError(t, err)
+
+	_, err = wo.GetMessage()
+	assert.Equal(t, ErrMessageTooLarge, err)
+}
+
+// Feeds data to a Conn and throws away anything written to it
+type fuzzConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (f *fuzzConn) Read(b []byte) (int, error) {
+	return f.r.Read(b)
+}
+
+func (f *fuzzConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// Create a client Conn reading data, keyed the same way as the server
+// returned by fuzzWriter.
+func fuzzReader(t testing.TB, data []byte) *Conn {
+	c := &Conn{
+		Conn:     &fuzzConn{r: bytes.NewReader(data)},
+		version:  Version2,
+		suite:    CipherSuiteByID(AES128GCM),
+		writeBuf: make([]byte, WriteBufferSize),
+		privKey:  new([32]byte),
+		pubKey:   new([32]byte),
+	}
+
+	keys := [][]byte{make([]byte, 16), make([]byte, 16)}
+	keys[1][0] = 1
+
+	require.NoError(t, c.setupHalves(keys))
+
+	return c
+}
+
+// Return a server Conn that sends records the client from fuzzReader
+// can read, and the buffer they're written to.
+func fuzzWriter(t testing.TB) (*Conn, *bytes.Buffer) {
+	c := fuzzReader(t, nil)
+	c.server = true
+
+	keys := [][]byte{make([]byte, 16), make([]byte, 16)}
+	keys[1][0] = 1
+
+	require.NoError(t, c.setupHalves(keys))
+
+	cc := &countingConn{hold: true}
+	c.Conn = cc
+	c.rekeyLeft = 1 << 30
+
+	return c, &cc.held
+}
+
+func FuzzRead(f *testing.F) {
+	w, out := fuzzWriter(f)
+
+	w.Write([]byte("hello"))
+	w.startRekey(RekeyRequested)
+	f.Add(append([]byte(nil), out.Bytes()...))
+
+	f.Add([]byte{0xff, 0xff, 0xff, 0x00})
+	f.Add([]byte{0x00, 0x00, 0x10, 0x01})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := fuzzReader(t, data)
+
+		buf := make([]byte, 64)
+
+		for {
+			_, err := c.Read(buf)
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+func FuzzGetMessage(f *testing.F) {
+	w, out := fuzzWriter(f)
+
+	w.SendMessage([]byte("hello"))
+	f.Add(append([]byte(nil), out.Bytes()...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := fuzzReader(t, data)
+
+		msg, err := c.GetMessage()
+		if err == nil {
+			assert.True(t, len(msg) <= MaxMessageSize)
+		}
+	})
+}
+
+func FuzzHelloUnmarshal(f *testing.F) {
+	h := &hello{
+		versions: supportedVersions,
+		random:   make([]byte, helloRandomSize),
+	}
+
+	h.addExtension(extCipherSuites, marshalUint16s(DefaultCipherSuites))
+	h.addExtension(extLimits, make([]byte, 8))
+
+	f.Add(h.marshal())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var h hello
+
+		if h.unmarshal(data) == nil {
+			assert.Equal(t, data, h.marshal())
+		}
+	})
+}
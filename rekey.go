@@ -0,0 +1,429 @@
+package seconn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// A rekey replaces the keys for both directions with ones from a fresh
+// curve25519 exchange, and either side may start one:
+//
+//   1. The side starting it sends pStartRekey with a new public key and IV.
+//   2. The other side answers with pClientKeyUpdate, carrying its own new
+//      public key, and switches its writes to the new key.
+//   3. The side that started it switches both directions and sends
+//      pFinalizeRekey, after which the other side switches its reads.
+//
+// If both sides start a rekey at once, the server's wins. The server
+// ignores the client's pStartRekey, and the client answers the server's
+// instead of waiting for an answer to its own.
+//
+// All of the rekey state is guarded by writeLock. Read takes it to act
+// on a rekey record, so the key for our direction is only ever replaced
+// between two records, never while one is being sealed.
+
+// Where a connection is in a rekey
+type rekeyState int
+
+const (
+	rekeyIdle rekeyState = iota
+
+	// We sent pStartRekey and are waiting for pClientKeyUpdate
+	rekeyStarted
+
+	// We sent pClientKeyUpdate and are waiting for pFinalizeRekey
+	rekeyAnswered
+)
+
+// Why the keys changed, passed to Config.OnRekey
+type RekeyReason int
+
+const (
+	// We had sent RekeyAfterBytes with the old keys
+	RekeyBytes RekeyReason = iota + 1
+
+	// The old keys were older than KeyValidityPeriod
+	RekeyTime
+
+	// RekeyNext was called
+	RekeyRequested
+
+	// The peer started it
+	RekeyPeer
+
+	// A key update replaced the key for one direction
+	RekeyKeyUpdate
+)
+
+var rekeyReasonNames = map[RekeyReason]string{
+	RekeyBytes:     "bytes",
+	RekeyTime:      "time",
+	RekeyRequested: "requested",
+	RekeyPeer:      "peer",
+	RekeyKeyUpdate: "key update",
+}
+
+func (r RekeyReason) String() string {
+	if name, ok := rekeyReasonNames[r]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("reason(%d)", int(r))
+}
+
+// Return how many times the keys have changed since the handshake, in
+// either direction. It goes up by one for every rekey and key update,
+// so both sides agree on it once they've read everything the other
+// sent.
+func (c *Conn) KeyEpoch() uint64 {
+	return atomic.LoadUint64(&c.epoch)
+}
+
+// Return how many bytes of payload and how many records we've sent with
+// the current key for our direction.
+func (c *Conn) KeyUsage() (bytes, records int64) {
+	if c.write == nil {
+		return 0, 0
+	}
+
+	return atomic.LoadInt64(&c.write.bytes), atomic.LoadInt64(&c.write.records)
+}
+
+// Move to the next key epoch and tell Config.OnRekey. The caller must
+// hold writeLock.
+func (c *Conn) keyChanged(reason RekeyReason) {
+	epoch := atomic.AddUint64(&c.epoch, 1)
+
+	if fn := c.config.onRekey(); fn != nil {
+		fn(epoch, reason)
+	}
+}
+
+// On the next Write(), rekey the stream. It's safe to call at any time,
+// including while another goroutine is in Read or Write.
+func (c *Conn) RekeyNext() {
+	atomic.StoreInt32(&c.rekeyNext, 1)
+}
+
+// Start counting towards the next rekey from now. The caller must hold
+// writeLock.
+func (c *Conn) resetRekeyLimits() {
+	c.rekeyLeft = c.config.rekeyAfterBytes()
+	c.rekeyAfter = time.Now().Add(c.config.keyValidityPeriod())
+
+	atomic.StoreInt32(&c.rekeyNext, 0)
+}
+
+// Start a rekey before writing n bytes if the current key has been used
+// for long enough, otherwise count the bytes against it. The caller must
+// hold writeLock.
+func (c *Conn) checkRekey(n int) error {
+	reason, due := c.rekeyDue()
+	if !due {
+		c.rekeyLeft -= n
+		return nil
+	}
+
+	// The peer can't answer a rekey any more, so just replace
+	// the key for our direction.
+	if c.peerClosed {
+		return c.oneWayRekey(reason)
+	}
+
+	// Wait for the rekey in progress to finish
+	if c.rekeyState != rekeyIdle {
+		return nil
+	}
+
+	return c.startRekey(reason)
+}
+
+// Return whether it's time to rekey, and why. The caller must hold
+// writeLock.
+func (c *Conn) rekeyDue() (RekeyReason, bool) {
+	switch {
+	case atomic.LoadInt32(&c.rekeyNext) == 1:
+		return RekeyRequested, true
+	case c.rekeyLeft <= 0:
+		return RekeyBytes, true
+	case !time.Now().Before(c.rekeyAfter):
+		return RekeyTime, true
+	}
+
+	return 0, false
+}
+
+// Rekey once the key validity period has passed, even if nothing is
+// being written.
+func (c *Conn) startRekeyTimer() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.rekeyTimerStopped {
+		return
+	}
+
+	c.rekeyTimer = time.AfterFunc(time.Until(c.rekeyAfter), c.rekeyTimerFired)
+}
+
+func (c *Conn) stopRekeyTimer() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.rekeyTimer != nil {
+		c.rekeyTimer.Stop()
+	}
+
+	c.rekeyTimerStopped = true
+}
+
+func (c *Conn) rekeyTimerFired() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	// Nothing more can be sent, so there's no key to replace
+	if c.rekeyTimerStopped || c.closeSent || c.peerAlert != nil {
+		return
+	}
+
+	if !time.Now().Before(c.rekeyAfter) {
+		var err error
+
+		if c.peerClosed {
+			err = c.oneWayRekey(RekeyTime)
+		} else if c.rekeyState == rekeyIdle {
+			err = c.startRekey(RekeyTime)
+		}
+
+		// Write will report the problem
+		if err != nil {
+			return
+		}
+	}
+
+	next := time.Until(c.rekeyAfter)
+
+	// The peer still hasn't finished a rekey it started, try again
+	// once it has had a while longer.
+	if next <= 0 {
+		next = c.config.keyValidityPeriod()
+	}
+
+	c.rekeyTimer.Reset(next)
+}
+
+// Send a new public key and IV to the peer. The caller must hold
+// writeLock.
+func (c *Conn) startRekey(reason RekeyReason) error {
+	c.resetRekeyLimits()
+
+	pub, priv, err := GenerateKey(c.config.rand())
+	if err != nil {
+		return err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+
+	_, err = io.ReadFull(c.config.rand(), iv)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write((*pub)[:])
+	buf.Write(iv)
+
+	err = c.writeRecord(pStartRekey, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	c.nextPubKey = pub
+	c.nextPrivKey = priv
+	c.nextIv = iv
+	c.rekeyState = rekeyStarted
+	c.rekeyReason = reason
+
+	return nil
+}
+
+// Answer a rekey started by the peer
+func (c *Conn) readRekey(cnt uint32) error {
+	buf, err := c.readAndCheck(cnt)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) != cKeySize+aes.BlockSize {
+		return ErrBadRekey
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	switch c.rekeyState {
+	case rekeyStarted:
+		// The client will answer ours instead
+		if c.server {
+			return nil
+		}
+
+		c.clearNext()
+	case rekeyAnswered:
+		// The peer can't start another until it has finished this one
+		return ErrBadRekey
+	}
+
+	peerKey := new([32]byte)
+	copy((*peerKey)[:], buf[:cKeySize])
+
+	iv := buf[cKeySize:]
+
+	pub, priv, err := GenerateKey(c.config.rand())
+	if err != nil {
+		return err
+	}
+
+	shared := new([32]byte)
+
+	err = sharedSecret(shared, priv, peerKey)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeRecord(pClientKeyUpdate, (*pub)[:])
+	if err != nil {
+		// We've half closed, so the peer will have to finish
+		// without us. See CloseWrite.
+		if err == ErrWriteClosed {
+			return nil
+		}
+
+		return err
+	}
+
+	c.nextPubKey = pub
+	c.nextPrivKey = priv
+	c.nextPeerKey = peerKey
+	c.nextShared = shared
+	c.nextIv = iv
+	c.nextKeys = makeKeys((*shared)[:], iv, nil, c.suite.KeySize)
+	c.rekeyState = rekeyAnswered
+
+	return c.write.setup(c.suite, c.nextKeys[1], iv)
+}
+
+// Finish a rekey we started once the peer has answered it
+func (c *Conn) readRekeyAnswer(cnt uint32) error {
+	buf, err := c.readAndCheck(cnt)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) != cKeySize {
+		return ErrBadRekey
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.rekeyState != rekeyStarted {
+		return ErrBadRekey
+	}
+
+	c.nextPeerKey = new([32]byte)
+	copy((*c.nextPeerKey)[:], buf)
+
+	c.nextShared = new([32]byte)
+
+	err = sharedSecret(c.nextShared, c.nextPrivKey, c.nextPeerKey)
+	if err != nil {
+		return err
+	}
+
+	c.nextKeys = makeKeys((*c.nextShared)[:], c.nextIv, nil, c.suite.KeySize)
+
+	err = c.read.setup(c.suite, c.nextKeys[1], c.nextIv)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeRecord(pFinalizeRekey, nil)
+	if err != nil {
+		// We've half closed since starting the rekey. The peer's
+		// direction has switched already, ours never will.
+		if err == ErrWriteClosed {
+			c.clearNext()
+			return nil
+		}
+
+		return err
+	}
+
+	err = c.write.setup(c.suite, c.nextKeys[0], c.nextIv)
+	if err != nil {
+		return err
+	}
+
+	c.commitNext(c.rekeyReason)
+
+	return nil
+}
+
+// Switch our reads to the new key once the peer has finished the rekey
+func (c *Conn) readRekeyFinal(cnt uint32) error {
+	buf, err := c.readAndCheck(cnt)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) != 0 {
+		return ErrBadRekey
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.rekeyState != rekeyAnswered {
+		return ErrBadRekey
+	}
+
+	err = c.read.setup(c.suite, c.nextKeys[0], c.nextIv)
+	if err != nil {
+		return err
+	}
+
+	c.commitNext(RekeyPeer)
+
+	return nil
+}
+
+// Switch to the keys agreed in a completed rekey
+func (c *Conn) commitNext(reason RekeyReason) {
+	c.shared = c.nextShared
+	c.privKey = c.nextPrivKey
+	c.peerKey = c.nextPeerKey
+	c.pubKey = c.nextPubKey
+
+	// Both directions have fresh keys, whoever started it
+	c.resetRekeyLimits()
+
+	c.clearNext()
+
+	c.keyChanged(reason)
+}
+
+// Forget about a rekey in progress
+func (c *Conn) clearNext() {
+	c.nextShared = nil
+	c.nextPrivKey = nil
+	c.nextPubKey = nil
+	c.nextPeerKey = nil
+	c.nextIv = nil
+	c.nextKeys = nil
+	c.rekeyState = rekeyIdle
+}
@@ -0,0 +1,520 @@
+package seconn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRekeyFromClient(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	firstKey := *wc.shared
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		buf := make([]byte, 5)
+
+		_, err := io.ReadFull(wo, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "one..", string(buf))
+
+		_, err = wo.Write([]byte("two.."))
+		assert.NoError(t, err)
+
+		_, err = io.ReadFull(wo, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "three", string(buf))
+	}()
+
+	wc.RekeyNext()
+
+	_, err := wc.Write([]byte("one.."))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+
+	_, err = io.ReadFull(wc, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "two..", string(buf))
+
+	_, err = wc.Write([]byte("three"))
+	require.NoError(t, err)
+
+	wg.Wait()
+
+	assert.NotEqual(t, firstKey, *wc.shared)
+	assert.Equal(t, *wc.shared, *wo.shared)
+}
+
+func TestRekeyCollision(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	firstKey := *wc.shared
+
+	// Both sides start a rekey before seeing the other's
+	wo.RekeyNext()
+	wc.RekeyNext()
+
+	_, err := wo.Write([]byte("from server"))
+	require.NoError(t, err)
+
+	_, err = wc.Write([]byte("from client"))
+	require.NoError(t, err)
+
+	serverKey := *wo.nextPubKey
+
+	var wg sync.WaitGroup
+
+	for _, c := range []*Conn{wo, wc} {
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+
+			buf := make([]byte, 11)
+
+			_, err := io.ReadFull(c, buf)
+			assert.NoError(t, err)
+
+			// The second round makes sure both sides see the end
+			// of the rekey.
+			for _, msg := range []string{"after rekey", "second time"} {
+				_, err = c.Write([]byte(msg))
+				assert.NoError(t, err)
+
+				_, err = io.ReadFull(c, buf)
+				assert.NoError(t, err)
+				assert.Equal(t, msg, string(buf))
+			}
+		}(c)
+	}
+
+	wg.Wait()
+
+	// The server's rekey won
+	assert.NotEqual(t, firstKey, *wc.shared)
+	assert.Equal(t, *wc.shared, *wo.shared)
+	assert.Equal(t, serverKey, *wc.peerKey)
+}
+
+// Send data and rekey as often as possible in both directions at once,
+// so that both sides keep starting rekeys while records are in flight.
+func TestRekeyBidirectionalTraffic(t *testing.T) {
+	cfg := &Config{
+		WriteBufferSize: 1024,
+		RekeyAfterBytes: 2048,
+	}
+
+	wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	firstKey := *wc.shared
+
+	const (
+		chunkSize = 1000
+		chunks    = 500
+	)
+
+	var wg sync.WaitGroup
+
+	for _, pair := range [][2]*Conn{{wo, wc}, {wc, wo}} {
+		data := make([]byte, chunkSize*chunks)
+
+		_, err := io.ReadFull(rand.Reader, data)
+		require.NoError(t, err)
+
+		from, to := pair[0], pair[1]
+
+		// Keep the writer close behind the reader, so that rekeys
+		// are answered while data is still being sent.
+		credits := make(chan struct{}, 16)
+
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < chunks; i++ {
+				credits <- struct{}{}
+
+				_, err := from.Write(data[i*chunkSize : (i+1)*chunkSize])
+				if !assert.NoError(t, err) {
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, chunkSize)
+
+			for i := 0; i < chunks; i++ {
+				_, err := io.ReadFull(to, buf)
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				if !assert.True(t, bytes.Equal(data[i*chunkSize:(i+1)*chunkSize], buf)) {
+					return
+				}
+
+				<-credits
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	assert.NotEqual(t, firstKey, *wc.shared)
+}
+
+func TestRekeyTimerOnIdleConnection(t *testing.T) {
+	scfg := &Config{KeyValidityPeriod: 20 * time.Millisecond}
+
+	wo, wc, serr, cerr := negotiatePair(t, scfg, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	firstKey := *wc.shared
+
+	// Nothing is written, both sides just read so the rekeys can be
+	// answered.
+	serverDone := make(chan error, 1)
+	clientDone := make(chan error, 1)
+
+	go func() {
+		_, err := ioutil.ReadAll(wo)
+		serverDone <- err
+	}()
+
+	go func() {
+		_, err := ioutil.ReadAll(wc)
+		clientDone <- err
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, wc.CloseWrite())
+	assert.NoError(t, <-serverDone)
+
+	wo.Close()
+	assert.NoError(t, <-clientDone)
+
+	wc.Close()
+
+	assert.NotEqual(t, firstKey, *wc.shared)
+	assert.Equal(t, *wc.shared, *wo.shared)
+}
+
+func TestRekeyTimerStopsOnClose(t *testing.T) {
+	cfg := &Config{KeyValidityPeriod: 10 * time.Millisecond}
+
+	wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+
+	go ioutil.ReadAll(wo)
+
+	time.Sleep(50 * time.Millisecond)
+
+	wc.Close()
+
+	// Already stopped, so it won't fire again
+	assert.False(t, wc.rekeyTimer.Stop())
+}
+
+// Read, Write, force rekeys and look at the connection from separate
+// goroutines on both sides at once. Run with -race.
+func TestRekeyConcurrentReadWrite(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	const (
+		msgSize = 512
+		msgs    = 200
+	)
+
+	stop := make(chan struct{})
+
+	var (
+		wg      sync.WaitGroup
+		meddler sync.WaitGroup
+	)
+
+	for _, pair := range [][2]*Conn{{wo, wc}, {wc, wo}} {
+		from, to := pair[0], pair[1]
+
+		wg.Add(2)
+		meddler.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			msg := make([]byte, msgSize)
+
+			for i := 0; i < msgs; i++ {
+				msg[0] = byte(i)
+
+				_, err := from.Write(msg)
+				if !assert.NoError(t, err) {
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, msgSize)
+
+			for i := 0; i < msgs; i++ {
+				_, err := io.ReadFull(to, buf)
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				assert.Equal(t, byte(i), buf[0])
+			}
+		}()
+
+		go func() {
+			defer meddler.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				from.RekeyNext()
+				from.AuthToken()
+
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	close(stop)
+	meddler.Wait()
+}
+
+func TestRekeyYamux(t *testing.T) {
+	cfg := &Config{RekeyAfterBytes: 4096}
+
+	wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	ssess, err := yamux.Server(wo, nil)
+	require.NoError(t, err)
+
+	defer ssess.Close()
+
+	csess, err := yamux.Client(wc, nil)
+	require.NoError(t, err)
+
+	defer csess.Close()
+
+	// Echo every stream back
+	go func() {
+		for {
+			str, err := ssess.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer str.Close()
+				io.Copy(str, str)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		str, err := csess.OpenStream()
+		require.NoError(t, err)
+
+		data := make([]byte, 32*1024)
+
+		_, err = io.ReadFull(rand.Reader, data)
+		require.NoError(t, err)
+
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := str.Write(data)
+			assert.NoError(t, err)
+		}()
+
+		go func() {
+			defer wg.Done()
+			defer str.Close()
+
+			buf := make([]byte, len(data))
+
+			_, err := io.ReadFull(str, buf)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(data, buf))
+		}()
+	}
+
+	wg.Wait()
+}
+
+type rekeyEvent struct {
+	epoch  uint64
+	reason RekeyReason
+}
+
+// Collect the OnRekey calls for a connection
+func recordRekeys(cfg *Config) chan rekeyEvent {
+	events := make(chan rekeyEvent, 16)
+
+	cfg.OnRekey = func(epoch uint64, reason RekeyReason) {
+		events <- rekeyEvent{epoch, reason}
+	}
+
+	return events
+}
+
+func TestRekeyOnRekey(t *testing.T) {
+	scfg := &Config{}
+	ccfg := &Config{}
+
+	sevents := recordRekeys(scfg)
+	cevents := recordRekeys(ccfg)
+
+	wo, wc, serr, cerr := negotiatePair(t, scfg, ccfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	assert.Equal(t, uint64(0), wc.KeyEpoch())
+
+	// Keep the server reading and echoing so the rekey completes
+	go io.Copy(wo, wo)
+
+	buf := make([]byte, 5)
+
+	wc.RekeyNext()
+
+	_, err := wc.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(wc, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, rekeyEvent{1, RekeyRequested}, <-cevents)
+	assert.Equal(t, rekeyEvent{1, RekeyPeer}, <-sevents)
+
+	require.NoError(t, wc.UpdateKey())
+
+	_, err = wc.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(wc, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, rekeyEvent{2, RekeyKeyUpdate}, <-cevents)
+	assert.Equal(t, rekeyEvent{2, RekeyKeyUpdate}, <-sevents)
+
+	assert.Equal(t, uint64(2), wc.KeyEpoch())
+	assert.Equal(t, uint64(2), wo.KeyEpoch())
+
+	bytes, records := wc.KeyUsage()
+	assert.Equal(t, int64(5), bytes)
+	assert.Equal(t, int64(1), records)
+}
+
+func TestRekeyReasons(t *testing.T) {
+	cfg := &Config{RekeyAfterBytes: 10}
+
+	events := recordRekeys(cfg)
+
+	wo, wc, serr, cerr := negotiatePair(t, nil, cfg)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	go io.Copy(wo, wo)
+
+	buf := make([]byte, 20)
+
+	// Goes over the limit, so the next write rekeys
+	_, err := wc.Write(buf)
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(wc, buf)
+	require.NoError(t, err)
+
+	_, err = wc.Write(buf)
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(wc, buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, rekeyEvent{1, RekeyBytes}, <-events)
+	assert.Equal(t, "bytes", RekeyBytes.String())
+}
+
+func TestRekeyRejectsLowOrderKey(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wo.Close()
+	defer wc.Close()
+
+	// The all zero point makes every shared secret zero
+	wc.writeLock.Lock()
+	err := wc.writeRecord(pStartRekey, make([]byte, cKeySize+16))
+	wc.writeLock.Unlock()
+	require.NoError(t, err)
+
+	_, err = wo.Read(make([]byte, 5))
+	assert.Equal(t, ErrMalformedKey, err)
+}
@@ -2,66 +2,122 @@ package seconn
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"hash"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vektra/errors"
 
-	"crypto/aes"
+	"crypto"
 	"crypto/cipher"
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 
-	"code.google.com/p/go.crypto/curve25519"
-	"code.google.com/p/go.crypto/hkdf"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 )
 
-// The size of the internal encrypted write buffer
+// The size of the internal encrypted write buffer. This is the default
+// used when a Config doesn't set WriteBufferSize.
 var WriteBufferSize = 128
 
+// The largest record payload accepted from the peer. This is the default
+// used when a Config doesn't set MaxRecordSize.
+var MaxRecordSize = 64 * 1024
+
+// The largest message accepted by GetMessage. This is the default used
+// when a Config doesn't set MaxMessageSize.
+var MaxMessageSize = 16 * 1024 * 1024
+
+// The smallest record size limit that can be used. Rekey records have
+// to fit.
+const MinRecordSize = 256
+
 // How many bytes to write over the connection before we rekey
 // This is bidirectional, so it will trip whenever either side
-// has sent this ammount.
+// has sent this ammount. This is the default used when a Config
+// doesn't set RekeyAfterBytes.
 var RekeyAfterBytes = 100 * 1024 * 1024
 
+// How long a key is used before we rekey. This is the default used
+// when a Config doesn't set KeyValidityPeriod.
 var KeyValidityPeriod = 1 * time.Hour
 
 var ErrBadRekey = errors.New("error in rekey processing")
 
 var ErrProtocolError = errors.New("protocol error")
 
+var ErrDecryptFailed = errors.New("record failed to decrypt")
+
+var ErrWriteClosed = errors.New("connection closed for writing")
+
+var ErrRecordTooLarge = errors.New("record exceeds the maximum record size")
+
+var ErrMessageTooLarge = errors.New("message exceeds the maximum message size")
+
 const cKeySize = 32
 
+// How long Close waits to send the close notify
+const closeNotifyTimeout = 5 * time.Second
+
 const (
 	pData            uint32 = 0
 	pStartRekey      uint32 = 1
 	pClientKeyUpdate uint32 = 2
 	pFinalizeRekey   uint32 = 3
+	pCloseNotify     uint32 = 4
+	pOneWayRekey     uint32 = 5
+	pAlert           uint32 = 6
+	pPing            uint32 = 7
+	pPong            uint32 = 8
+	pKeyUpdate       uint32 = 9
 )
 
+// A Conn is safe for one goroutine to Read while others Write. Rekeys
+// are driven from both sides: Read answers the peer's rekey records and
+// Write (or the rekey timer) starts our own. Everything either side can
+// touch is guarded by writeLock, so a key is never swapped while a
+// record is being sealed with it.
 type Conn struct {
+	// How many times the keys have changed. First so that it's
+	// aligned for atomic access.
+	epoch uint64
+
 	net.Conn
+	config *Config
+
+	server   bool
+	version  uint16
+	suite    *CipherSuite
+	writeBuf []byte
+
+	// Guards everything below up to the fields only used by Read
+	writeLock sync.Mutex
+
 	privKey *[32]byte
 	pubKey  *[32]byte
 	peerKey *[32]byte
 	shared  *[32]byte
 
-	server   bool
-	writeBuf []byte
-	readBuf  bytes.Buffer
+	write     *half
+	recordBuf []byte
 
 	rekeyAfter time.Time
 	rekeyLeft  int
+	rekeyTimer *time.Timer
+	rekeyState rekeyState
 
-	writeLock sync.Mutex
+	// Set by Close, so a timer that fired as it was stopped doesn't
+	// start itself again
+	rekeyTimerStopped bool
 
-	read  *half
-	write *half
+	// Why we started the rekey in progress
+	rekeyReason RekeyReason
 
 	nextPubKey  *[32]byte
 	nextPrivKey *[32]byte
@@ -70,27 +126,76 @@ type Conn struct {
 	nextKeys    [][]byte
 	nextIv      []byte
 
+	// Set once we've sent or received a close notify
+	closeSent  bool
+	peerClosed bool
+
+	// The alert the peer sent us, if any
+	peerAlert *AlertError
+
+	// Only used by Read, which must not be called concurrently
+	read      *half
+	readBuf   bytes.Buffer
 	headerBuf []byte
+
+	// Returned by every Read once reading can't continue
+	readErr error
+
+	// Set to 1 by RekeyNext, without taking writeLock
+	rekeyNext int32
+
+	// How many calls to Write are in progress, so Close knows not to
+	// wait for writeLock behind one that's blocked.
+	activeWrites int32
+
+	ping pinger
+
+	// Handshake state used to decide what alert to send on failure
+	alerted    bool
+	authFailed bool
+	peerDone   bool
+
+	peerStatic   *[32]byte
+	peerIdentity crypto.PublicKey
+
+	// The limits the peer advertised, or 0 if it didn't
+	peerMaxRecord  int
+	peerMaxMessage int
+
+	transcript    hash.Hash
+	handshakeHash []byte
+	handshakeSalt []byte
+
+	// What ExportKeyingMaterial derives from, fixed by the handshake
+	exporterSecret []byte
+
+	// Returned by AuthToken and PeerAuthToken
+	clientToken []byte
+	serverToken []byte
 }
 
 type half struct {
+	// What's been sent with this key, only counted for the write
+	// half. Updated atomically so that KeyUsage doesn't need a lock.
+	bytes   int64
+	records int64
+
 	aead cipher.AEAD
 	seq  []byte
+	key  []byte
 }
 
-func (h *half) setup(key, iv []byte) error {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-
-	aead, err := cipher.NewGCM(block)
+func (h *half) setup(suite *CipherSuite, key, iv []byte) error {
+	aead, err := suite.New(key)
 	if err != nil {
 		return err
 	}
 
 	h.aead = aead
 	h.seq = make([]byte, aead.NonceSize())
+	h.key = append([]byte(nil), key...)
+	atomic.StoreInt64(&h.bytes, 0)
+	atomic.StoreInt64(&h.records, 0)
 
 	return nil
 }
@@ -121,177 +226,226 @@ func GenerateKey(rand io.Reader) (publicKey, privateKey *[32]byte, err error) {
 	return
 }
 
-// Create a new connection. Negotiate must be called before the
-// connection can be used.
-func NewConn(c net.Conn) (*Conn, error) {
+// Compute the curve25519 secret we share with the holder of peerKey.
+// A low order peerKey gives an all zero secret that anyone could work
+// out, so it's rejected with ErrMalformedKey.
+func sharedSecret(shared, privateKey, peerKey *[32]byte) error {
+	curve25519.ScalarMult(shared, privateKey, peerKey)
+
+	var zero [32]byte
+
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return ErrMalformedKey
+	}
+
+	return nil
+}
+
+// Create a new connection using the settings in config, which may be nil.
+// Negotiate must be called before the connection can be used.
+func NewConn(c net.Conn, config *Config) (*Conn, error) {
 	conn := &Conn{
 		Conn:     c,
-		writeBuf: make([]byte, 128),
+		config:   config,
+		writeBuf: make([]byte, config.writeBufferSize()),
 	}
 
 	return conn, nil
 }
 
-// Create a new connection and negotiate as the client
-func NewClient(u net.Conn) (*Conn, error) {
-	c, err := NewConn(u)
+// Create a new connection and negotiate as the client. If the handshake
+// fails, u is closed and the error is returned.
+func NewClient(u net.Conn, config *Config) (*Conn, error) {
+	c, err := NewConn(u, config)
 	if err != nil {
 		return nil, err
 	}
 
-	c.Negotiate(false)
+	err = c.Negotiate(false)
+	if err != nil {
+		u.Close()
+		return nil, err
+	}
 
 	return c, nil
 }
 
-// Create a new connection and negotiate as the server
-func NewServer(u net.Conn) (*Conn, error) {
-	c, err := NewConn(u)
+// Create a new connection and negotiate as the server. If the handshake
+// fails, u is closed and the error is returned.
+func NewServer(u net.Conn, config *Config) (*Conn, error) {
+	c, err := NewConn(u, config)
 	if err != nil {
 		return nil, err
 	}
 
-	c.Negotiate(true)
+	err = c.Negotiate(true)
+	if err != nil {
+		u.Close()
+		return nil, err
+	}
 
 	return c, nil
 }
 
-// On the next Write(), rekey the stream
-func (c *Conn) RekeyNext() {
-	c.rekeyLeft = 0
-}
-
-func makeKeys(shared, salt, info []byte) [][]byte {
+func makeKeys(shared, salt, info []byte, size int) [][]byte {
 	hkdf := hkdf.New(sha512.New, shared, salt, info)
 
-	k1 := make([]byte, aes.BlockSize)
-	k2 := make([]byte, aes.BlockSize)
+	k1 := make([]byte, size)
+	k2 := make([]byte, size)
 
-	if n, err := io.ReadFull(hkdf, k1); n != aes.BlockSize || err != nil {
+	if n, err := io.ReadFull(hkdf, k1); n != size || err != nil {
 		panic("unable to derive key")
 	}
 
-	if n, err := io.ReadFull(hkdf, k2); n != aes.BlockSize || err != nil {
+	if n, err := io.ReadFull(hkdf, k2); n != size || err != nil {
 		panic("unable to derive key")
 	}
 
 	return [][]byte{k1, k2}
 }
 
-// Exchange keys and setup the encryption
+// Exchange keys and setup the encryption. A peer hanging up or the
+// handshake timing out are reported as ErrPeerClosed and
+// ErrHandshakeTimeout.
 func (c *Conn) Negotiate(server bool) error {
-	pub, priv, err := GenerateKey(rand.Reader)
-	if err != nil {
-		return err
-	}
-
-	c.pubKey = pub
-	c.privKey = priv
-
-	c.server = server
+	return c.NegotiateContext(context.Background(), server)
+}
 
-	err = binary.Write(c.Conn, binary.BigEndian, uint32(len(c.pubKey)))
-	if err != nil {
+// Like Negotiate, but gives up when ctx is done, returning ctx.Err().
+// The earlier of ctx's deadline and the configured HandshakeTimeout is
+// set on the underlying connection for the duration of the handshake.
+func (c *Conn) NegotiateContext(ctx context.Context, server bool) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	n, err := c.Conn.Write((*c.pubKey)[:])
-	if err != nil {
-		return err
-	}
+	var deadline time.Time
 
-	if n != len(c.pubKey) {
-		return io.ErrShortWrite
+	if timeout := c.config.handshakeTimeout(); timeout > 0 {
+		deadline = time.Now().Add(timeout)
 	}
 
-	other := uint32(0)
+	ctxDeadline := false
 
-	err = binary.Read(c.Conn, binary.BigEndian, &other)
-	if err != nil {
-		return err
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+		ctxDeadline = true
 	}
 
-	c.peerKey = new([32]byte)
-
-	n, err = c.Conn.Read((*c.peerKey)[:])
-	if err != nil {
-		return err
+	if !deadline.IsZero() {
+		err := c.Conn.SetDeadline(deadline)
+		if err != nil {
+			return err
+		}
 	}
 
-	if n != len(c.peerKey) {
-		return io.ErrShortBuffer
-	}
+	var stop, done chan struct{}
 
-	c.shared = new([32]byte)
+	if ctx.Done() != nil {
+		stop = make(chan struct{})
+		done = make(chan struct{})
 
-	curve25519.ScalarMult(c.shared, c.privKey, c.peerKey)
+		go func() {
+			defer close(done)
 
-	var iv []byte
+			select {
+			case <-ctx.Done():
+				// Unblock any read or write in progress
+				c.Conn.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+	}
 
-	if server {
-		err = binary.Read(c.Conn, binary.BigEndian, &other)
-		if err != nil {
-			return err
+	// Wait for the watcher first, so it can't set a deadline after
+	// we've cleared it. It may have fired even if the handshake
+	// succeeded, so the deadline is always cleared.
+	defer func() {
+		if stop != nil {
+			close(stop)
+			<-done
 		}
 
-		iv = make([]byte, other)
+		c.Conn.SetDeadline(time.Time{})
+	}()
 
-		n, err := io.ReadFull(c.Conn, iv)
-		if err != nil {
-			return err
-		}
+	err := c.negotiate(server)
+	if err != nil {
+		c.handshakeAlert(err)
 
-		if n != int(other) {
-			return io.ErrShortBuffer
-		}
-	} else {
-		iv = make([]byte, aes.BlockSize)
-		n, err := io.ReadFull(rand.Reader, iv)
-		if err != nil {
-			return err
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
 		}
 
-		if n != aes.BlockSize {
-			return io.ErrShortBuffer
-		}
+		err = handshakeError(err)
 
-		err = binary.Write(c.Conn, binary.BigEndian, uint32(len(iv)))
-		if err != nil {
-			return err
+		// The connection's deadline can pass a moment before ctx
+		// notices its own.
+		if err == ErrHandshakeTimeout && ctxDeadline {
+			return context.DeadlineExceeded
 		}
 
-		n, err = c.Conn.Write(iv)
+		return err
+	}
+
+	if verify := c.config.verifyConnection(); verify != nil {
+		err = verify(c)
 		if err != nil {
+			c.sendAlert(AlertAuthFailed, "")
+
+			if cerr := ctx.Err(); cerr != nil {
+				return cerr
+			}
+
 			return err
 		}
+	}
 
-		if n != len(iv) {
-			return io.ErrShortWrite
-		}
+	// ctx may have ended after the last handshake message, for instance
+	// while VerifyConnection ran.
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	c.rekeyLeft = RekeyAfterBytes
+	c.startKeepalive()
+	c.startRekeyTimer()
+
+	return nil
+}
 
-	c.read = &half{}
-	c.write = &half{}
+// Connect to addr on the named network and negotiate as the client.
+// ctx bounds both the dial and the handshake.
+func DialContext(ctx context.Context, network, addr string, config *Config) (*Conn, error) {
+	var d net.Dialer
 
-	sharedKey := (*c.shared)[:]
+	u, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
 
-	newKeys := makeKeys(sharedKey, iv, nil)
+	c, err := NewConn(u, config)
+	if err != nil {
+		u.Close()
+		return nil, err
+	}
 
-	if c.server {
-		c.read.setup(newKeys[1], iv)
-		c.write.setup(newKeys[0], iv)
-	} else {
-		c.read.setup(newKeys[0], iv)
-		c.write.setup(newKeys[1], iv)
+	err = c.NegotiateContext(ctx, false)
+	if err != nil {
+		u.Close()
+		return nil, err
 	}
 
-	c.headerBuf = make([]byte, 4+c.write.aead.Overhead())
+	return c, nil
+}
 
-	c.rekeyAfter = time.Now().Add(KeyValidityPeriod)
+// Return the ID of the cipher suite negotiated for this connection.
+// See CipherSuiteName to turn it into a string.
+func (c *Conn) CipherSuite() uint16 {
+	if c.suite == nil {
+		return 0
+	}
 
-	return nil
+	return c.suite.ID
 }
 
 // A token that can be compared with the other sides PeerAuthToken
@@ -301,28 +455,47 @@ func (c *Conn) Negotiate(server bool) error {
 // The token needs to be authenticated across the connection because
 // seconn doesn't detect a rogue man-in-the-middle. This token is in fact
 // used to detect a man-in-the-middle.
-
+//
+// It's derived from the handshake secret and a hash of every handshake
+// message, so it commits to the whole session. The client and server
+// tokens use different labels, so a token can't be reflected back to
+// the side that sent it. It doesn't change when the connection rekeys.
 func (c *Conn) AuthToken() []byte {
-	mac := hmac.New(sha256.New, (*c.shared)[:])
-	mac.Write((*c.pubKey)[:])
-	return mac.Sum(nil)
+	if c.server {
+		return c.serverToken
+	}
+
+	return c.clientToken
 }
 
 // See AuthToken(). This is the AuthToken for the other side of the connection.
-
 func (c *Conn) PeerAuthToken() []byte {
-	mac := hmac.New(sha256.New, (*c.shared)[:])
-	mac.Write((*c.peerKey)[:])
-	return mac.Sum(nil)
+	if c.server {
+		return c.clientToken
+	}
+
+	return c.serverToken
 }
 
 func (c *Conn) readAndCheck(cnt uint32) ([]byte, error) {
+	// readHeader has already opened the whole record
+	if c.headerInClear() {
+		pt := make([]byte, c.readBuf.Len())
+		c.readBuf.Read(pt)
+
+		return pt, nil
+	}
+
 	wireCnt := int(cnt) + c.read.aead.Overhead()
 
 	buf := make([]byte, wireCnt)
 
 	n, err := io.ReadFull(c.Conn, buf)
 	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
 		return nil, err
 	}
 
@@ -331,113 +504,125 @@ func (c *Conn) readAndCheck(cnt uint32) ([]byte, error) {
 	}
 
 	pt, err := c.read.aead.Open(buf[:0], c.read.seq, buf, nil)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+
 	c.read.incSeq()
 
-	return pt, err
+	return pt, nil
 }
 
-func (c *Conn) readRekey(cnt uint32) error {
+var ErrBadHeader = errors.New("bad header")
+
+func (c *Conn) readCloseNotify(cnt uint32) error {
 	buf, err := c.readAndCheck(cnt)
 	if err != nil {
 		return err
 	}
 
-	if len(buf) != cKeySize+aes.BlockSize {
-		return ErrBadRekey
+	if len(buf) != 0 {
+		return ErrProtocolError
 	}
 
-	c.nextPeerKey = new([32]byte)
-	copy((*c.nextPeerKey)[:], buf[:cKeySize])
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.peerClosed = true
 
-	c.nextIv = buf[cKeySize:]
+	// A rekey the peer hasn't answered never will be, and neither will
+	// our pings
+	c.clearNext()
+	c.stopKeepalive()
 
-	return c.sendClientRekey()
+	return nil
 }
 
-func (c *Conn) readServerRekeyed(cnt uint32) error {
-	buf, err := c.readAndCheck(cnt)
-	if err != nil {
-		return err
-	}
+// Tell the peer we're done sending and close the connection. Does
+// nothing more than Close on the underlying connection if CloseWrite
+// was already called. The peer's
+// Read returns io.EOF once it has read everything we sent, while a
+// connection that's cut without this returns io.ErrUnexpectedEOF.
+func (c *Conn) Close() error {
+	c.stopKeepalive()
 
-	if len(buf) != cKeySize {
-		return ErrBadRekey
+	// A Write that's blocked on a peer that stopped reading would hold
+	// up the close notify forever, and Close is how it gets aborted.
+	// So only send one when nothing else is writing, and don't wait
+	// long for it. This is what crypto/tls does too.
+	if atomic.LoadInt32(&c.activeWrites) == 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+		c.sendCloseNotify()
 	}
 
-	c.nextPeerKey = new([32]byte)
-	copy((*c.nextPeerKey)[:], buf[:cKeySize])
-
-	c.nextShared = new([32]byte)
-
-	curve25519.ScalarMult(c.nextShared, c.nextPrivKey, c.nextPeerKey)
-
-	sharedKey := (*c.nextShared)[:]
-
-	c.nextKeys = makeKeys(sharedKey, c.nextIv, nil)
+	// Closing first aborts any blocked write holding writeLock
+	err := c.Conn.Close()
 
-	c.read.setup(c.nextKeys[1], c.nextIv)
+	c.stopRekeyTimer()
 
-	return c.sendServerRekeyed()
+	return err
 }
 
-func (c *Conn) readClientRekeyFinal(size uint32) error {
-	buf, err := c.readAndCheck(size)
-	if err != nil {
-		return err
-	}
+func (c *Conn) sendCloseNotify() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 
-	if len(buf) != 0 {
-		return ErrBadRekey
+	// Nothing to do if the handshake never finished
+	if c.write == nil || c.closeSent {
+		return nil
 	}
 
-	c.read.setup(c.nextKeys[0], c.nextIv)
-
-	c.shared = c.nextShared
-	c.privKey = c.nextPrivKey
-	c.peerKey = c.nextPeerKey
-	c.pubKey = c.nextPubKey
+	err := c.writeRecord(pCloseNotify, nil)
 
-	c.nextShared = nil
-	c.nextPrivKey = nil
-	c.nextPeerKey = nil
-	c.nextPeerKey = nil
-	c.nextIv = nil
-	c.nextKeys = nil
+	c.closeSent = true
 
-	return nil
+	return err
 }
 
-var ErrBadHeader = errors.New("bad header")
-
-// Read data into buf, automatically decrypting it
+// Read data into buf, automatically decrypting it. If the peer sent an
+// alert, it's returned as an *AlertError.
 func (c *Conn) Read(buf []byte) (int, error) {
-	n, err := c.readBuf.Read(buf)
-	if n > 0 {
-		return n, err
-	}
-
-retry:
-	n, err = io.ReadFull(c.Conn, c.headerBuf)
-	if err != nil {
-		return 0, err
+	// What's left of the last record comes first. Reading the next one
+	// needs readBuf empty, even when buf is.
+	if c.readBuf.Len() > 0 {
+		return c.readBuf.Read(buf)
 	}
 
-	if n != len(c.headerBuf) {
-		return 0, io.ErrShortBuffer
+	// Once the peer has closed, sent an alert or broken the protocol
+	// there's nothing more to read.
+	if c.readErr != nil {
+		return 0, c.readErr
 	}
 
-	header, err := c.read.aead.Open(c.headerBuf[:0], c.read.seq, c.headerBuf, nil)
+	n, err := c.readRecord(buf)
 	if err != nil {
-		return 0, errors.Cause(ErrBadHeader, err)
+		err = c.keepaliveError(err)
+		c.readFailed(err)
 	}
 
-	c.read.incSeq()
+	return n, err
+}
 
-	cnt := binary.BigEndian.Uint32(header)
+// Decide whether err ends reading for good, telling the peer why if
+// it's their fault.
+func (c *Conn) readFailed(err error) {
+	if _, ok := err.(*AlertError); ok || err == io.EOF {
+		c.readErr = err
+		return
+	}
 
-	cmd := cnt & 0xff
+	if code, ok := alertFor(err); ok {
+		c.readErr = err
+		c.sendAlert(code, "")
+	}
+}
 
-	cnt = cnt >> 8
+func (c *Conn) readRecord(buf []byte) (int, error) {
+retry:
+	cmd, cnt, err := c.readHeader()
+	if err != nil {
+		return 0, err
+	}
 
 	switch cmd {
 	case pData:
@@ -449,42 +634,61 @@ retry:
 		}
 		goto retry
 	case pClientKeyUpdate:
-		err = c.readServerRekeyed(cnt)
+		err = c.readRekeyAnswer(cnt)
 		if err != nil {
 			return 0, err
 		}
 		goto retry
 	case pFinalizeRekey:
-		err = c.readClientRekeyFinal(cnt)
+		err = c.readRekeyFinal(cnt)
+		if err != nil {
+			return 0, err
+		}
+		goto retry
+	case pOneWayRekey:
+		err = c.readOneWayRekey(cnt)
+		if err != nil {
+			return 0, err
+		}
+		goto retry
+	case pPing:
+		err = c.readPing(cnt)
 		if err != nil {
 			return 0, err
 		}
 		goto retry
+	case pPong:
+		err = c.readPong(cnt)
+		if err != nil {
+			return 0, err
+		}
+		goto retry
+	case pKeyUpdate:
+		err = c.readKeyUpdate(cnt)
+		if err != nil {
+			return 0, err
+		}
+		goto retry
+	case pAlert:
+		return 0, c.readAlert(cnt)
+	case pCloseNotify:
+		err = c.readCloseNotify(cnt)
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
 	default:
 		return 0, ErrProtocolError
 	}
 
-	wireCnt := cnt + uint32(c.write.aead.Overhead())
-
-	io.CopyN(&c.readBuf, c.Conn, int64(wireCnt))
-
-	pt, err := c.read.aead.Open(
-		c.readBuf.Bytes()[:0],
-		c.read.seq,
-		c.readBuf.Bytes(),
-		nil,
-	)
-
-	if err != nil {
-		return 0, err
+	// From Version2 on, readHeader has already put the payload in readBuf
+	if !c.headerInClear() {
+		err = c.readPayload(cnt)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	c.read.incSeq()
-
-	// Because we rewrite the buffer to contain the plaintext, we need to truncate
-	// it to that size since otherwise it will still contain some of the ciphertext
-	c.readBuf.Truncate(len(pt))
-
 	var toExtract int
 
 	if len(buf) < int(cnt) {
@@ -502,203 +706,95 @@ retry:
 	return read, nil
 }
 
-func (c *Conn) sendBuffer(cmd uint32, buf *bytes.Buffer) error {
-	var headerData [4]byte
-
-	header := headerData[:]
-
-	headerInt := cmd | uint32(buf.Len()<<8)
+// Read and open a Version1 data payload into readBuf
+func (c *Conn) readPayload(cnt uint32) error {
+	wireCnt := cnt + uint32(c.read.aead.Overhead())
 
-	binary.BigEndian.PutUint32(header, headerInt)
-
-	c.writeLock.Lock()
-	defer c.writeLock.Unlock()
-
-	ct := c.write.aead.Seal(c.writeBuf[:0], c.write.seq, header, nil)
-	c.write.incSeq()
-
-	n, err := c.Conn.Write(ct)
-	if err != nil {
-		return err
-	}
-
-	if n != len(ct) {
-		return io.ErrShortWrite
-	}
-
-	buf.Grow(c.write.aead.Overhead())
-
-	ct = c.write.aead.Seal(buf.Bytes()[:0], c.write.seq, buf.Bytes(), nil)
-	c.write.incSeq()
-
-	n, err = c.Conn.Write(ct)
+	_, err := io.CopyN(&c.readBuf, c.Conn, int64(wireCnt))
 	if err != nil {
-		return err
-	}
-
-	if n != len(ct) {
-		return io.ErrShortWrite
-	}
+		c.readBuf.Reset()
 
-	return nil
-}
-
-func (c *Conn) startRekey() error {
-	c.rekeyLeft = RekeyAfterBytes
-	c.rekeyAfter = time.Now().Add(KeyValidityPeriod)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
 
-	pub, priv, err := GenerateKey(rand.Reader)
-	if err != nil {
 		return err
 	}
 
-	c.nextPubKey = pub
-	c.nextPrivKey = priv
+	pt, err := c.read.aead.Open(
+		c.readBuf.Bytes()[:0],
+		c.read.seq,
+		c.readBuf.Bytes(),
+		nil,
+	)
 
-	iv := make([]byte, aes.BlockSize)
-	n, err := io.ReadFull(rand.Reader, iv)
 	if err != nil {
-		return err
-	}
-
-	if n != aes.BlockSize {
-		return io.ErrShortBuffer
+		c.readBuf.Reset()
+		return ErrDecryptFailed
 	}
 
-	c.nextIv = iv
-
-	var buf bytes.Buffer
-	buf.Write((*pub)[:])
-	buf.Write(iv)
+	c.read.incSeq()
 
-	err = c.sendBuffer(pStartRekey, &buf)
-	if err != nil {
-		return err
-	}
+	// Because we rewrite the buffer to contain the plaintext, we need to truncate
+	// it to that size since otherwise it will still contain some of the ciphertext
+	c.readBuf.Truncate(len(pt))
 
 	return nil
 }
 
-func (c *Conn) sendClientRekey() error {
-	pub, priv, err := GenerateKey(rand.Reader)
-	if err != nil {
-		return err
-	}
-
-	c.nextPubKey = pub
-	c.nextPrivKey = priv
-
-	var buf bytes.Buffer
-	buf.Write((*pub)[:])
+// Write data, automatically encrypting it
+func (c *Conn) Write(buf []byte) (int, error) {
+	atomic.AddInt32(&c.activeWrites, 1)
+	defer atomic.AddInt32(&c.activeWrites, -1)
 
-	err = c.sendBuffer(pClientKeyUpdate, &buf)
+	n, err := c.writeData(buf)
 	if err != nil {
-		return err
+		return n, c.keepaliveError(err)
 	}
 
-	c.nextShared = new([32]byte)
-
-	curve25519.ScalarMult(c.nextShared, c.nextPrivKey, c.nextPeerKey)
-
-	sharedKey := (*c.nextShared)[:]
-
-	c.nextKeys = makeKeys(sharedKey, c.nextIv, nil)
-
-	c.write.setup(c.nextKeys[1], c.nextIv)
-
-	return nil
+	return n, nil
 }
 
-func (c *Conn) sendServerRekeyed() error {
-	var buf bytes.Buffer
+func (c *Conn) writeData(buf []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 
-	err := c.sendBuffer(pFinalizeRekey, &buf)
+	err := c.checkRekey(len(buf))
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	c.write.setup(c.nextKeys[0], c.nextIv)
-
-	c.shared = c.nextShared
-	c.privKey = c.nextPrivKey
-	c.peerKey = c.nextPeerKey
-	c.pubKey = c.nextPubKey
-
-	c.nextShared = nil
-	c.nextPrivKey = nil
-	c.nextPeerKey = nil
-	c.nextPeerKey = nil
-	c.nextIv = nil
-	c.nextKeys = nil
-
-	return nil
-}
-
-// Write data, automatically encrypting it
-func (c *Conn) Write(buf []byte) (int, error) {
-	var headerData [4]byte
-
-	header := headerData[:]
-
-	var err error
+	total := len(buf)
 
-	if c.server && c.nextPeerKey == nil {
-		if c.rekeyLeft <= 0 || time.Now().After(c.rekeyAfter) {
-			err = c.startRekey()
-		} else {
-			c.rekeyLeft -= len(buf)
-		}
+	size := len(c.writeBuf)
+	if c.peerMaxRecord > 0 && c.peerMaxRecord < size {
+		size = c.peerMaxRecord
 	}
 
-	if err != nil {
-		return 0, err
+	if size > maxRecordField {
+		size = maxRecordField
 	}
 
-	total := len(buf)
-
-	c.writeLock.Lock()
-	defer c.writeLock.Unlock()
-
 	for len(buf) > 0 {
 		var chunk []byte
 
-		if len(c.writeBuf) >= len(buf) {
+		if size >= len(buf) {
 			chunk = buf
 			buf = nil
 		} else {
-			chunk = buf[:len(c.writeBuf)]
-			buf = buf[len(c.writeBuf):]
+			chunk = buf[:size]
+			buf = buf[size:]
 		}
 
-		headerInt := uint32(len(chunk)) << 8
-
-		binary.BigEndian.PutUint32(header, headerInt)
-
-		ct := c.write.aead.Seal(c.writeBuf[:0], c.write.seq, header, nil)
-
-		c.write.incSeq()
-
-		n, err := c.Conn.Write(ct)
+		err := c.checkKeyUpdate()
 		if err != nil {
 			return 0, err
 		}
 
-		if n != len(ct) {
-			return 0, io.ErrShortWrite
-		}
-
-		ct = c.write.aead.Seal(c.writeBuf[:0], c.write.seq, chunk, nil)
-
-		c.write.incSeq()
-
-		n, err = c.Conn.Write(ct)
+		err = c.writeRecord(pData, chunk)
 		if err != nil {
 			return 0, err
 		}
-
-		if n != len(ct) {
-			return 0, io.ErrShortWrite
-		}
 	}
 
 	return total, nil
@@ -713,6 +809,10 @@ func (c *Conn) GetMessage() ([]byte, error) {
 		return nil, err
 	}
 
+	if int64(l) > int64(c.config.maxMessageSize()) {
+		return nil, ErrMessageTooLarge
+	}
+
 	buf := make([]byte, l)
 
 	n, err := io.ReadFull(c, buf)
@@ -729,6 +829,10 @@ func (c *Conn) GetMessage() ([]byte, error) {
 
 // Write msg to the other side
 func (c *Conn) SendMessage(msg []byte) error {
+	if c.peerMaxMessage > 0 && len(msg) > c.peerMaxMessage {
+		return ErrMessageTooLarge
+	}
+
 	err := binary.Write(c, binary.BigEndian, uint32(len(msg)))
 	if err != nil {
 		return err
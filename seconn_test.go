@@ -5,12 +5,16 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/yamux"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSeconnBasic(t *testing.T) {
@@ -26,7 +30,7 @@ func TestSeconnBasic(t *testing.T) {
 		o, err := l.Accept()
 		defer o.Close()
 
-		wo, err := NewServer(o)
+		wo, err := NewServer(o, nil)
 		assert.NoError(t, err)
 
 		n, err := wo.Write([]byte("hello"))
@@ -37,7 +41,7 @@ func TestSeconnBasic(t *testing.T) {
 	c, err := net.Dial("tcp", l.Addr().String())
 	defer c.Close()
 
-	wc, err := NewClient(c)
+	wc, err := NewClient(c, nil)
 	assert.NoError(t, err)
 
 	buf := make([]byte, 10)
@@ -63,7 +67,7 @@ func TestSeconnEncrypts(t *testing.T) {
 		o, err := l.Accept()
 		defer o.Close()
 
-		wo, err := NewConn(o)
+		wo, err := NewConn(o, nil)
 		assert.NoError(t, err)
 
 		err = wo.Negotiate(true)
@@ -77,7 +81,7 @@ func TestSeconnEncrypts(t *testing.T) {
 	c, err := net.Dial("tcp", l.Addr().String())
 	defer c.Close()
 
-	wc, err := NewConn(c)
+	wc, err := NewConn(c, nil)
 	assert.NoError(t, err)
 
 	err = wc.Negotiate(false)
@@ -115,7 +119,7 @@ func TestSeconnWriteBuffersProperly(t *testing.T) {
 		o, err := l.Accept()
 		defer o.Close()
 
-		wo, err := NewConn(o)
+		wo, err := NewConn(o, nil)
 		assert.NoError(t, err)
 
 		err = wo.Negotiate(true)
@@ -129,7 +133,7 @@ func TestSeconnWriteBuffersProperly(t *testing.T) {
 	c, err := net.Dial("tcp", l.Addr().String())
 	defer c.Close()
 
-	wc, err := NewConn(c)
+	wc, err := NewConn(c, nil)
 	assert.NoError(t, err)
 
 	err = wc.Negotiate(false)
@@ -157,7 +161,7 @@ func TestSeconnCanSendMessage(t *testing.T) {
 		o, err := l.Accept()
 		defer o.Close()
 
-		wo, err := NewServer(o)
+		wo, err := NewServer(o, nil)
 		assert.NoError(t, err)
 
 		auth, err := wo.GetMessage()
@@ -172,7 +176,7 @@ func TestSeconnCanSendMessage(t *testing.T) {
 	c, err := net.Dial("tcp", l.Addr().String())
 	defer c.Close()
 
-	wc, err := NewClient(c)
+	wc, err := NewClient(c, nil)
 	assert.NoError(t, err)
 
 	err = wc.SendMessage([]byte("vektra:rocks"))
@@ -201,7 +205,7 @@ func TestSeconnReKeyBasic(t *testing.T) {
 		o, err := l.Accept()
 		defer o.Close()
 
-		wo, err := NewServer(o)
+		wo, err := NewServer(o, nil)
 		assert.NoError(t, err)
 
 		n, err := wo.Write([]byte("hello 1"))
@@ -232,14 +236,12 @@ func TestSeconnReKeyBasic(t *testing.T) {
 	c, err := net.Dial("tcp", l.Addr().String())
 	defer c.Close()
 
-	wc, err := NewClient(c)
+	wc, err := NewClient(c, nil)
 	assert.NoError(t, err)
 
 	buf := make([]byte, 7)
 
-	firstKey := make([]byte, 32)
-
-	copy(firstKey, (*wc.shared)[:])
+	assert.Equal(t, uint64(0), wc.KeyEpoch())
 
 	n, err := wc.Read(buf)
 	assert.Equal(t, 7, n)
@@ -264,9 +266,7 @@ func TestSeconnReKeyBasic(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 7, n)
 
-	secondKey := (*wc.shared)[:]
-
-	assert.NotEqual(t, firstKey, secondKey)
+	assert.Equal(t, uint64(1), wc.KeyEpoch())
 
 	wg.Wait()
 }
@@ -294,7 +294,7 @@ func TestSeconnReadBuffersProperly(t *testing.T) {
 		o, err := l.Accept()
 		defer o.Close()
 
-		wo, err := NewConn(o)
+		wo, err := NewConn(o, nil)
 		assert.NoError(t, err)
 
 		err = wo.Negotiate(true)
@@ -308,7 +308,7 @@ func TestSeconnReadBuffersProperly(t *testing.T) {
 	c, err := net.Dial("tcp", l.Addr().String())
 	defer c.Close()
 
-	wc, err := NewConn(c)
+	wc, err := NewConn(c, nil)
 	assert.NoError(t, err)
 
 	err = wc.Negotiate(false)
@@ -345,7 +345,7 @@ func TestSeconnYamux(t *testing.T) {
 
 		o, err := l.Accept()
 
-		wo, err := NewServer(o)
+		wo, err := NewServer(o, nil)
 		assert.NoError(t, err)
 
 		sess, err := yamux.Server(wo, cfg)
@@ -366,7 +366,7 @@ func TestSeconnYamux(t *testing.T) {
 	c, err := net.Dial("tcp", l.Addr().String())
 	defer c.Close()
 
-	wc, err := NewClient(c)
+	wc, err := NewClient(c, nil)
 	assert.NoError(t, err)
 
 	sess, err := yamux.Client(wc, cfg)
@@ -397,7 +397,7 @@ func TestSeconnYamuxSimilar(t *testing.T) {
 
 		o, err := l.Accept()
 
-		wo, err := NewServer(o)
+		wo, err := NewServer(o, nil)
 		assert.NoError(t, err)
 
 		defer wo.Close()
@@ -419,7 +419,7 @@ func TestSeconnYamuxSimilar(t *testing.T) {
 	c, err := net.Dial("tcp", l.Addr().String())
 	defer c.Close()
 
-	wc, err := NewClient(c)
+	wc, err := NewClient(c, nil)
 	assert.NoError(t, err)
 
 	msg1 := []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0}
@@ -451,7 +451,7 @@ func TestSeconnReKeyDoesntSwitchTooEarly(t *testing.T) {
 		o, err := l.Accept()
 		defer o.Close()
 
-		wo, err := NewServer(o)
+		wo, err := NewServer(o, nil)
 		assert.NoError(t, err)
 
 		wo.Write([]byte("hello 1"))
@@ -466,7 +466,7 @@ func TestSeconnReKeyDoesntSwitchTooEarly(t *testing.T) {
 	c, err := net.Dial("tcp", l.Addr().String())
 	defer c.Close()
 
-	wc, err := NewClient(c)
+	wc, err := NewClient(c, nil)
 	assert.NoError(t, err)
 
 	buf := make([]byte, 7)
@@ -487,43 +487,221 @@ func TestSeconnReKeyDoesntSwitchTooEarly(t *testing.T) {
 }
 
 func TestSeconnAuthToken(t *testing.T) {
+	configs := map[string]*Config{
+		"default": nil,
+		"noise":   {Noise: &NoiseConfig{Pattern: NoiseNN}},
+	}
+
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			wo, wc, serr, cerr := negotiatePair(t, cfg, cfg)
+			require.NoError(t, serr)
+			require.NoError(t, cerr)
+
+			defer wo.Close()
+			defer wc.Close()
+
+			// Bound to the whole transcript, with a label per role
+			hash := wc.transcript.Sum(nil)
+
+			mac := hmac.New(sha256.New, wc.exporterSecret)
+			mac.Write([]byte("seconn auth token client"))
+			mac.Write(hash)
+
+			assert.Equal(t, mac.Sum(nil), wc.AuthToken())
+
+			assert.Equal(t, wc.AuthToken(), wo.PeerAuthToken())
+			assert.Equal(t, wo.AuthToken(), wc.PeerAuthToken())
+			assert.NotEqual(t, wc.AuthToken(), wc.PeerAuthToken())
+
+			// Rekeying doesn't change them
+			token := wc.AuthToken()
+
+			go io.Copy(wo, wo)
+
+			wc.RekeyNext()
+
+			_, err := wc.Write([]byte("hello"))
+			require.NoError(t, err)
+
+			_, err = io.ReadFull(wc, make([]byte, 5))
+			require.NoError(t, err)
+
+			assert.Equal(t, uint64(1), wc.KeyEpoch())
+			assert.Equal(t, token, wc.AuthToken())
+		})
+	}
+}
+
+// Negotiate a client and server using the given configs, returning both
+// conns and the errors from each side.
+func negotiatePair(t *testing.T, scfg, ccfg *Config) (*Conn, *Conn, error, error) {
 	l, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
 	defer l.Close()
 
-	var wg sync.WaitGroup
+	var (
+		wg   sync.WaitGroup
+		wo   *Conn
+		serr error
+	)
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
 		o, err := l.Accept()
-		defer o.Close()
+		if !assert.NoError(t, err) {
+			return
+		}
 
-		wo, err := NewServer(o)
+		wo, err = NewConn(o, scfg)
 		assert.NoError(t, err)
 
-		n, err := wo.Write([]byte("hello"))
-		assert.NoError(t, err)
-		assert.Equal(t, 5, n)
+		serr = wo.Negotiate(true)
+		if serr != nil {
+			o.Close()
+		}
 	}()
 
 	c, err := net.Dial("tcp", l.Addr().String())
-	defer c.Close()
+	require.NoError(t, err)
+
+	wc, err := NewConn(c, ccfg)
+	require.NoError(t, err)
 
-	wc, err := NewClient(c)
+	cerr := wc.Negotiate(false)
+	if cerr != nil {
+		c.Close()
+	}
+
+	wg.Wait()
+
+	return wo, wc, serr, cerr
+}
+
+func TestSeconnCloseNotify(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wc.Close()
+
+	go func() {
+		wo.Write([]byte("hello"))
+		wo.Close()
+	}()
+
+	data, err := ioutil.ReadAll(wc)
 	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
 
-	mac := hmac.New(sha256.New, (*wc.shared)[:])
-	mac.Write((*wc.pubKey)[:])
-	expected := mac.Sum(nil)
+	// And it stays closed
+	_, err = wc.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
 
-	assert.Equal(t, expected, wc.AuthToken())
+func TestSeconnCloseDuringBlockedWrite(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
 
-	mc2 := hmac.New(sha256.New, (*wc.shared)[:])
-	mc2.Write((*wc.peerKey)[:])
-	expected2 := mc2.Sum(nil)
+	defer wo.Close()
 
-	assert.Equal(t, expected2, wc.PeerAuthToken())
+	// wo never reads, so this fills the socket buffers and blocks
+	written := make(chan error, 1)
 
-	wg.Wait()
+	go func() {
+		_, err := wc.Write(make([]byte, 64*1024*1024))
+		written <- err
+	}()
+
+	for atomic.LoadInt32(&wc.activeWrites) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+
+	go func() {
+		wc.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked behind a Write")
+	}
+
+	select {
+	case err := <-written:
+		assert.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write wasn't aborted by Close")
+	}
+}
+
+func TestSeconnDetectsTruncation(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wc.Close()
+
+	go func() {
+		wo.Write([]byte("hello"))
+
+		// Hang up the way an injected FIN would
+		wo.Conn.Close()
+	}()
+
+	data, err := ioutil.ReadAll(wc)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestSeconnDetectsForgedHeader(t *testing.T) {
+	// Version 2 headers are in the clear, so an attacker can inject one
+	// for an empty record and then a FIN.
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wc.Close()
+
+	_, err := wo.Conn.Write([]byte{0, 0, 0, 0})
+	require.NoError(t, err)
+
+	wo.Conn.Close()
+
+	_, err = wc.Read(make([]byte, 5))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestSeconnDetectsTruncatedRecord(t *testing.T) {
+	wo, wc, serr, cerr := negotiatePair(t, nil, nil)
+	require.NoError(t, serr)
+	require.NoError(t, cerr)
+
+	defer wc.Close()
+
+	raw := wo.Conn
+
+	cc := &countingConn{Conn: raw, hold: true}
+	wo.Conn = cc
+
+	_, err := wo.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	rec := cc.held.Bytes()
+
+	_, err = raw.Write(rec[:len(rec)-3])
+	require.NoError(t, err)
+
+	raw.Close()
+
+	_, err = wc.Read(make([]byte, 5))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
 }